@@ -1,13 +1,28 @@
 package main
 
 import (
+        "bufio"
+        "bytes"
+        "crypto/hmac"
+        "crypto/sha256"
+        "encoding/base64"
         "encoding/json"
+        "errors"
         "flag"
         "io"
+        "io/ioutil"
         "log"
         "net/http"
+        "net/url"
         "os"
+        "os/signal"
+        "path/filepath"
+        "sort"
+        "strconv"
+        "strings"
+        "sync"
         "sync/atomic"
+        "syscall"
         "time"
         "github.com/gorilla/websocket"
 )
@@ -23,30 +38,459 @@ type CONFIGURATION struct {
     ToEdged string `json:"toedged_path"`
     ToEdgeAccess string `json:"toedgeaccess_path"`
     BiAsync string `json:"biasync_path"`
+
+    //topology labels advertised to placement: region, zone, rack, version
+    Labels map[string]string `json:"labels"`
+
+    //key shared with placement to verify the placement tickets, the links
+    //without a valid ticket are rejected if set
+    TicketKey string `json:"ticket_key"`
+
+    //maximum number of edged sessions, reported to placement, 0 means no limit
+    MaxConn int `json:"max_conn"`
+
+    //register to placement on startup if configured, and renew it
+    //every register_interval seconds
+    PlacementURL string `json:"placementURL"`
+    RegisterInterval int `json:"register_interval"`
+
+    //token sent in the admin_token header when registering to placement,
+    //and required from placement to rebalance. Rebalance is refused if
+    //not set
+    AdminToken string `json:"admin_token"`
+
+    //the edge nodes attached are reported to the node directory in
+    //placement. For the edge node attached to another EdgeAccess, the
+    //request is forwarded to it, or redirected if directory_miss is
+    //"redirect"
+    DirectoryMiss string `json:"directory_miss"`
+
+    //seconds to wait for the reply of edged on the downlink, 10 if not set
+    DownLinkTimeout int `json:"downlink_timeout"`
+
+    //messages queued to each edge node, 64 if not set. When it is full
+    //the new message is rejected, or the oldest one is dropped if
+    //downlink_overflow is "drop_oldest"
+    DownLinkQueueDepth int `json:"downlink_queue_depth"`
+    DownLinkOverflow string `json:"downlink_overflow"`
+
+    //seconds to hold the message sent to an offline edge node, 300 if
+    //not set
+    DownLinkQueueTTL int `json:"downlink_queue_ttl"`
+
+    //commands in flight for one fan-out request, 64 if not set
+    FanOutConcurrency int `json:"fanout_concurrency"`
+
+    //upper bound of the timeout asked by a command, in seconds, 60 if
+    //not set
+    MaxCommandTimeout int `json:"max_command_timeout"`
+
+    //samples kept in memory for each edge node, 1024 if not set. The
+    //samples evicted are spilled to telemetry_spill_dir if set, up to
+    //telemetry_spill_max_bytes (10MB if not set) for each file
+    TelemetryCapacity int `json:"telemetry_capacity"`
+    TelemetrySpillDir string `json:"telemetry_spill_dir"`
+    TelemetrySpillMaxBytes int64 `json:"telemetry_spill_max_bytes"`
 }
 
 
+// MESSAGE is the envelope on the uplink and downlink. The message of
+// version 0 is the legacy one with only Body and Reply, its topic is
+// taken from the link it comes from
 type MESSAGE struct {
+    Version     int     `json:"version,omitempty"`
     ID          uint64  `json:"id"`
     TimeStamp   int64   `json:"timestamp"`
-    Body        string  `json:"body"` //just CPU utilization here
+
+    Type        string  `json:"type,omitempty"` //request, reply or error
+    Topic       string  `json:"topic,omitempty"`
+
+    //content type of the payload, application/json or text/plain
+    ContentType string          `json:"content_type,omitempty"`
+    Payload     json.RawMessage `json:"payload,omitempty"`
+
+    //of the reply, the http status code is used
+    Status      int     `json:"status,omitempty"`
+    Error       string  `json:"error,omitempty"`
+
+    Body        string  `json:"body"` //legacy text body, the CPU utilization
     Reply       string  `json:"reply"` //one filed to send back by the replier
 }
 
+const MESSAGE_VERSION = 1
+
+const (
+    MSG_REQUEST = "request"
+    MSG_REPLY   = "reply"
+    MSG_ERROR   = "error"
+)
+
+// topics of the messages, the legacy uplink message is telemetry, the
+// legacy downlink message is ping
+const (
+    TOPIC_TELEMETRY    = "telemetry"
+    TOPIC_PING         = "ping"
+    TOPIC_COMMAND      = "command"
+    TOPIC_CONFIG       = "config"
+    TOPIC_RECONNECT    = "ctrl.reconnect"
+    TOPIC_NOTIFICATION = "notification"
+)
+
+func newRequest(topic string) MESSAGE {
+    var newMsg MESSAGE
+    newMsg.Version   = MESSAGE_VERSION
+    newMsg.ID        = newID()
+    newMsg.TimeStamp = time.Now().Unix()
+    newMsg.Type      = MSG_REQUEST
+    newMsg.Topic     = topic
+    newMsg.Reply     = "" //will be touched by the receiver
+    return newMsg
+}
+
+// newReply answers the request with the same ID and topic, the legacy
+// fields are kept for the legacy edged
+func newReply(in *MESSAGE) MESSAGE {
+    reply := *in
+    reply.Version   = MESSAGE_VERSION
+    reply.Type      = MSG_REPLY
+    reply.Status    = http.StatusOK
+    reply.ContentType = ""
+    reply.Payload   = nil
+    return reply
+}
+
+func newErrorReply(in *MESSAGE, status int, err error) MESSAGE {
+    reply := newReply(in)
+    reply.Type   = MSG_ERROR
+    reply.Status = status
+    reply.Error  = err.Error()
+    return reply
+}
+
+// handlers of the messages from edged by the topic, both of the uplink
+// and of the BiAsync link. The reply is sent back on the uplink, and only
+// logged on error for the BiAsync link
+var topicHandlers = map[string]func(edgenode_id string, in *MESSAGE) MESSAGE{
+    TOPIC_TELEMETRY:    handleTelemetryMsg,
+    TOPIC_NOTIFICATION: handleNotificationMsg,
+}
+
+// dispatchTopic hands the message to the handler of its topic
+func dispatchTopic(edgenode_id string, in *MESSAGE) MESSAGE {
+    if in.Version > MESSAGE_VERSION {
+        return newErrorReply(in, http.StatusBadRequest,
+                             errors.New("unsupported message version"))
+    }
+
+    topic := in.Topic
+    if topic == "" {
+        topic = TOPIC_TELEMETRY
+    }
+    handler := topicHandlers[topic]
+    if handler == nil {
+        return newErrorReply(in, http.StatusNotFound,
+                             errors.New("no handler for topic " + topic))
+    }
+    return handler(edgenode_id, in)
+}
+
+// TELEMETRY_PAYLOAD is the payload of the telemetry message
+type TELEMETRY_PAYLOAD struct {
+    CPU         *float64 `json:"cpu"`
+}
+
+var errNoCPU = errors.New("no cpu in the telemetry")
+
+func handleTelemetryMsg(edgenode_id string, in *MESSAGE) MESSAGE {
+    var err error
+    if len(in.Payload) > 0 {
+        var payload TELEMETRY_PAYLOAD
+        err = json.Unmarshal(in.Payload, &payload)
+        if err == nil && payload.CPU == nil {
+            err = errNoCPU
+        }
+        if err == nil {
+            addSample(edgenode_id, in.TimeStamp, *payload.CPU)
+        }
+    } else {
+        err = recordSample(edgenode_id, in.TimeStamp, in.Body)
+    }
+    if err != nil {
+        return newErrorReply(in, http.StatusBadRequest, err)
+    }
+
+    reply := newReply(in)
+    reply.Reply = "touched by EdgeAccess at" + (time.Now()).Format("2006-01-02 15:04:05")
+    return reply
+}
+
+
+// ASYNC_EVENT is the fire-and-forget event on the BiAsync link, in both
+// directions, handled by the topic
+type ASYNC_EVENT struct {
+    Topic       string  `json:"topic"`
+    TimeStamp   int64   `json:"timestamp"`
+    Body        string  `json:"body"`
+}
 
 type CONN_SESSION struct{
     upLinkCH chan MESSAGE
-    downLinkCH chan MESSAGE
     upLinkConn *websocket.Conn
     downLinkConn *websocket.Conn
     biAsyncLinkConn *websocket.Conn
+
+    //closed when the link is replaced or removed, each link is redialed
+    //by edged alone
+    upLinkDone chan struct{}
+    downLinkDone chan struct{}
+    biAsyncDone chan struct{}
+
+    //events queued to send on the BiAsync link
+    biAsyncCH chan ASYNC_EVENT
+
+    //closed when the session is closed
+    done chan struct{}
+
+    ident NODE_IDENTITY
+}
+
+// NODE_IDENTITY is sent by edged on linking, used to select the edge nodes
+type NODE_IDENTITY struct {
+    ProjectID   string
+    Labels      map[string]string
+}
+
+// nodeIdentity reads the project id and the labels "k1=v1,k2=v2" of the
+// edge node from the link request
+func nodeIdentity(r *http.Request) NODE_IDENTITY {
+    ident := NODE_IDENTITY{ProjectID: r.Header.Get("project_id"),
+                           Labels:    make(map[string]string)}
+    for _, kv := range strings.Split(r.Header.Get("edgenode_labels"), ",") {
+        pair := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+        if len(pair) == 2 && pair[0] != "" {
+            ident.Labels[pair[0]] = pair[1]
+        }
+    }
+    return ident
+}
+
+func newSession() *CONN_SESSION {
+    return &CONN_SESSION{
+        biAsyncCH: make(chan ASYNC_EVENT, BIASYNC_QUEUE),
+        done:      make(chan struct{}),
+    }
+}
+
+// SessionManager owns the sessions of the edge nodes attached, it is
+// shared by the http handlers, so all the access goes through the lock.
+// The link of the edge node is replaced in its session when edged links
+// it again, the goroutines of the old link can only detach their own
+type SessionManager struct {
+    lock   sync.RWMutex
+    items  map[string]*CONN_SESSION //keyed by edge node id
+}
+
+func NewSessionManager() *SessionManager {
+    return &SessionManager{items: make(map[string]*CONN_SESSION)}
+}
+
+// session returns the session of the edge node, created if not found,
+// m.lock must be held
+func (m *SessionManager) session(edgenode_id string, ident NODE_IDENTITY) *CONN_SESSION {
+    s := m.items[edgenode_id]
+    if s == nil {
+        s = newSession()
+        m.items[edgenode_id] = s
+    }
+    s.ident = ident
+    return s
+}
+
+// closeLink closes the link and wakes up its goroutines, nothing is done
+// if there is no link
+func closeLink(conn *websocket.Conn, done chan struct{}) {
+    if conn == nil {
+        return
+    }
+    close(done)
+    conn.Close()
+}
+
+// AttachDownLink adds the downlink to the session of the edge node. The
+// downlink left by the edged linked again is closed alone, the other
+// links of the session are kept. Return the session and the channel
+// closed when this downlink is replaced or removed
+func (m *SessionManager) AttachDownLink(edgenode_id string, ident NODE_IDENTITY,
+                                        conn *websocket.Conn) (*CONN_SESSION, chan struct{}) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    s := m.session(edgenode_id, ident)
+    closeLink(s.downLinkConn, s.downLinkDone)
+    s.downLinkConn = conn
+    s.downLinkDone = make(chan struct{})
+    return s, s.downLinkDone
+}
+
+// AttachUpLink adds the uplink to the session of the edge node, the old
+// uplink is replaced like AttachDownLink
+func (m *SessionManager) AttachUpLink(edgenode_id string, ident NODE_IDENTITY,
+                                      conn *websocket.Conn) (*CONN_SESSION, chan struct{}) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    s := m.session(edgenode_id, ident)
+    closeLink(s.upLinkConn, s.upLinkDone)
+    s.upLinkConn = conn
+    s.upLinkDone = make(chan struct{})
+    if s.upLinkCH == nil {
+        s.upLinkCH = make(chan MESSAGE)
+    }
+    return s, s.upLinkDone
+}
+
+// AttachBiAsync adds the BiAsync link to the session of the edge node, the
+// old BiAsync link is replaced like AttachDownLink. The events queued are
+// kept for the new link
+func (m *SessionManager) AttachBiAsync(edgenode_id string, ident NODE_IDENTITY,
+                                       conn *websocket.Conn) (*CONN_SESSION, chan struct{}) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    s := m.session(edgenode_id, ident)
+    closeLink(s.biAsyncLinkConn, s.biAsyncDone)
+    s.biAsyncLinkConn = conn
+    s.biAsyncDone = make(chan struct{})
+    return s, s.biAsyncDone
+}
+
+// Get returns the session of the edge node, nil if not attached
+func (m *SessionManager) Get(edgenode_id string) *CONN_SESSION {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+    return m.items[edgenode_id]
+}
+
+// DownLink returns the downlink of the edge node and the channel closed
+// when it's replaced or removed, the downlink is nil if edged has not
+// linked it yet
+func (m *SessionManager) DownLink(edgenode_id string) (*websocket.Conn, chan struct{}) {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+
+    s := m.items[edgenode_id]
+    if s == nil {
+        return nil, nil
+    }
+    return s.downLinkConn, s.downLinkDone
+}
+
+// BiAsync returns the session and its BiAsync link, the link is nil if
+// edged has not linked it yet
+func (m *SessionManager) BiAsync(edgenode_id string) (*CONN_SESSION, *websocket.Conn) {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+
+    s := m.items[edgenode_id]
+    if s == nil {
+        return nil, nil
+    }
+    return s, s.biAsyncLinkConn
+}
+
+// Select returns the ids of the edge nodes with a downlink matched by the
+// selector, sorted
+func (m *SessionManager) Select(sel *SELECTOR) []string {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+
+    ids := make([]string, 0)
+    for edgenode_id, s := range m.items {
+        if s.downLinkConn != nil && sel.Match(edgenode_id, &s.ident) {
+            ids = append(ids, edgenode_id)
+        }
+    }
+    sort.Strings(ids)
+    return ids
+}
+
+// DetachLink closes and removes the link if it is still the current one
+// of the session, so only one of the callers gets true. The session is
+// removed with its last link, and last is true for the caller to close it
+func (m *SessionManager) DetachLink(edgenode_id string, s *CONN_SESSION,
+                                    conn *websocket.Conn) (bool, bool) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    if s == nil || conn == nil || m.items[edgenode_id] != s {
+        return false, false
+    }
+    switch conn {
+    case s.downLinkConn:
+        closeLink(s.downLinkConn, s.downLinkDone)
+        s.downLinkConn, s.downLinkDone = nil, nil
+    case s.upLinkConn:
+        closeLink(s.upLinkConn, s.upLinkDone)
+        s.upLinkConn, s.upLinkDone = nil, nil
+    case s.biAsyncLinkConn:
+        closeLink(s.biAsyncLinkConn, s.biAsyncDone)
+        s.biAsyncLinkConn, s.biAsyncDone = nil, nil
+    default:
+        return false, false
+    }
+
+    if s.downLinkConn != nil || s.upLinkConn != nil || s.biAsyncLinkConn != nil {
+        return true, false
+    }
+    delete(m.items, edgenode_id)
+    return true, true
+}
+
+// Admit tells whether the edge node can link to this EdgeAccess, the one
+// attached already is always admitted, a new one only under max. No limit
+// if max is 0
+func (m *SessionManager) Admit(edgenode_id string, max int) bool {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+
+    if _, ok := m.items[edgenode_id]; ok || max <= 0 {
+        return true
+    }
+    return len(m.items) < max
+}
+
+func (m *SessionManager) Len() int {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+    return len(m.items)
+}
+
+// Range calls f on a snapshot of the sessions until f returns false, f
+// is called without the lock, so it can attach or detach sessions
+func (m *SessionManager) Range(f func(edgenode_id string, s *CONN_SESSION) bool) {
+    m.lock.RLock()
+    ids  := make([]string, 0, len(m.items))
+    list := make([]*CONN_SESSION, 0, len(m.items))
+    for id, s := range m.items {
+        ids  = append(ids, id)
+        list = append(list, s)
+    }
+    m.lock.RUnlock()
+
+    for i := range ids {
+        if !f(ids[i], list[i]) {
+            return
+        }
+    }
 }
 
 // global variables used in this file
 var globalCounter uint64
 var interrupt chan os.Signal
 var conf CONFIGURATION
-var mapSession map[string]*CONN_SESSION
+var sessions *SessionManager
+var queues *DownLinkQueues
+var telemetry *TelemetryStore
 
 /* note: error and  exception are not carefully handled here */
 
@@ -66,19 +510,32 @@ func initConfAndVar(conf *CONFIGURATION) error {
     // global varibles initialization
     globalCounter =  0
 
-    mapSession = make(map[string]*CONN_SESSION)
+    sessions = NewSessionManager()
+    queues   = NewDownLinkQueues()
 
     //load CLI parameters and configuration
     var f string
     flag.StringVar(&f, "f", "edgaccess.conf", "path for configuration file")
     flag.Parse()
 
-    return getConfig(conf, f)
+    err := getConfig(conf, f)
+    if err != nil {
+        return err
+    }
+
+    if conf.TelemetrySpillDir != "" {
+        err = os.MkdirAll(conf.TelemetrySpillDir, 0755)
+        if err != nil {
+            return err
+        }
+    }
+    telemetry = NewTelemetryStore(conf.TelemetryCapacity, conf.TelemetrySpillDir,
+                                  conf.TelemetrySpillMaxBytes)
+    return nil
 }
 
 func newID() uint64 {
-    atomic.AddUint64(&globalCounter, 1)
-    return globalCounter
+    return atomic.AddUint64(&globalCounter, 1)
 }
 
 
@@ -95,6 +552,30 @@ func getConfig( config *CONFIGURATION, f string) error {
         log.Println("configuration: ToEdged", config.ToEdged)
         log.Println("configuration: ToEdgeAccess", config.ToEdgeAccess)
         log.Println("configuration: BiAsync", config.BiAsync)
+        log.Println("configuration: Labels", config.Labels)
+        log.Println("configuration: TicketKey set", config.TicketKey != "")
+        log.Println("configuration: MaxConn", config.MaxConn)
+        log.Println("configuration: PlacementURL", config.PlacementURL)
+        log.Println("configuration: RegisterInterval", config.RegisterInterval)
+        log.Println("configuration: AdminToken set", config.AdminToken != "")
+        log.Println("configuration: DirectoryMiss", config.DirectoryMiss)
+        log.Println("configuration: DownLinkTimeout", config.DownLinkTimeout)
+        log.Println("configuration: DownLinkQueueDepth", config.DownLinkQueueDepth)
+        log.Println("configuration: DownLinkOverflow", config.DownLinkOverflow)
+        log.Println("configuration: DownLinkQueueTTL", config.DownLinkQueueTTL)
+        log.Println("configuration: FanOutConcurrency", config.FanOutConcurrency)
+        log.Println("configuration: MaxCommandTimeout", config.MaxCommandTimeout)
+        log.Println("configuration: TelemetryCapacity", config.TelemetryCapacity)
+        log.Println("configuration: TelemetrySpillDir", config.TelemetrySpillDir)
+        log.Println("configuration: TelemetrySpillMaxBytes", config.TelemetrySpillMaxBytes)
+    }
+
+    if err == nil && config.DownLinkOverflow != "" &&
+        config.DownLinkOverflow != OVERFLOW_REJECT &&
+        config.DownLinkOverflow != OVERFLOW_DROP_OLDEST {
+        err = errors.New("downlink_overflow should be " + OVERFLOW_REJECT +
+                         " or " + OVERFLOW_DROP_OLDEST + ", not " + config.DownLinkOverflow)
+        log.Println("configuration:", err)
     }
 
     return err
@@ -108,6 +589,25 @@ func StartServer() {
     http.HandleFunc(conf.ToEdged, handleSync2Edged)
     http.HandleFunc(conf.ToEdgeAccess, handleSync2EdgeAccess)
     http.HandleFunc("/v1.0/ping2edged", handlePing2Edged)
+    http.HandleFunc("/v1.0/send2edged", handleSend2Edged)
+    http.HandleFunc("/v1.0/handoff", handleHandoff)
+    http.HandleFunc("/v1.0/edged/", handleEdgedCommands)
+    http.HandleFunc("/v1.0/commands", handleFanOutCommands)
+    http.HandleFunc("/v1.0/telemetry/", handleTelemetry)
+    http.HandleFunc("/v1.0/rebalance", handleRebalance)
+    http.HandleFunc("/v1.0/async2edged", handleAsync2Edged)
+    if conf.BiAsync != "" {
+        http.HandleFunc(conf.BiAsync, handleBiAsync)
+    }
+
+    if conf.PlacementURL != "" {
+        go registerLoop()
+        go handoffLoop()
+    }
+    go purgeLoop()
+    if conf.TelemetrySpillDir != "" {
+        go telemetryFlushLoop()
+    }
 
     //use https instead
     //http.ListenAndServeTLS(conf.Host+":"+conf.Port, conf.Crt, conf.Key, nil)
@@ -119,6 +619,20 @@ func handleSync2Edged(w http.ResponseWriter, r *http.Request) {
     edgenode_id := r.Header.Get("edgenode_id")
     log.Println("handleSync2Edged ...", edgenode_id)
 
+    err := verifyTicket(r)
+    if err != nil {
+        log.Println("handleSync2Edged rejected", edgenode_id, err)
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    // placement may send more edged than max_conn with a stale view
+    if !sessions.Admit(edgenode_id, conf.MaxConn) {
+        log.Println("handleSync2Edged refused", edgenode_id, "max_conn reached")
+        http.Error(w, "EdgeAccess reaches max_conn", http.StatusServiceUnavailable)
+        return
+    }
+
     upgrader := websocket.Upgrader{}
     conn, err := upgrader.Upgrade(w, r, nil)
     if err != nil {
@@ -126,214 +640,2168 @@ func handleSync2Edged(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if mapSession[edgenode_id] == nil {
-        newSession := new(CONN_SESSION)
-        mapSession[edgenode_id] = newSession
-    }
-
-    //add the session to the map
-    mapSession[edgenode_id].downLinkConn = conn
-    mapSession[edgenode_id].downLinkCH   = make(chan MESSAGE)
+    //add the downlink to the session, the stale downlink is closed
+    edge, done := sessions.AttachDownLink(edgenode_id, nodeIdentity(r), conn)
 
     log.Println("Downlink for", edgenode_id, "established...")
 
-    // go handleDownLink(edgenode_id)
-}
+    reportDirectory(edgenode_id, DIRECTORY_ATTACH)
 
-func handleDownLink(edgenode_id string) {
+    go handleDownLink(edgenode_id, edge, conn, done)
+    go readDownLink(edgenode_id, edge, conn)
+}
 
-    edge := mapSession[edgenode_id]
-    if edge == nil { return }
+// PLACEMENT_TICKET is signed by placement for the edge node to link to
+// the EdgeAccess
+type PLACEMENT_TICKET struct {
+    EdgeNodeID     string `json:"edgenode_id"`
+    ProjectID      string `json:"project_id"`
+    EdgeAccess     string `json:"edgeaccess"` //host:port of the target
+    Expire         int64  `json:"expire"`
+}
 
-    defer func() {
-        if r := recover(); r != nil {
-            log.Println("Panic captured, removeConn in handleDownLink")
-            removeConn(edgenode_id)
-            return
-        }
-    }()
+// verifyTicket checks the placement_ticket header is signed by placement,
+// not expired, and issued for this edge node, project and EdgeAccess.
+// Nothing is checked if no ticket_key
+func verifyTicket(r *http.Request) error {
+    if conf.TicketKey == "" {
+        return nil
+    }
 
-    for {
-        select {
-        case downMsg := <-edge.downLinkCH:
-            req, _ := json.Marshal(downMsg)
-            err    := edge.downLinkConn.WriteMessage(websocket.TextMessage,
-                                                     []byte(string(req)))
-            if err != nil {
-                log.Println("failed to write message to: edgenode_id",
-                            edgenode_id, "for req", string(req))
-                removeConn(edgenode_id)
-                return
-            }
+    parts := strings.Split(r.Header.Get("placement_ticket"), ".")
+    if len(parts) != 2 {
+        return errors.New("invalid placement ticket")
+    }
+    payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil {
+        return errors.New("invalid placement ticket")
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return errors.New("invalid placement ticket")
+    }
 
-            log.Println("Send msg to downlink: edgenode_id", edgenode_id,
-                        "req", string(req))
+    mac := hmac.New(sha256.New, []byte(conf.TicketKey))
+    mac.Write(payload)
+    if !hmac.Equal(sig, mac.Sum(nil)) {
+        return errors.New("bad signature of placement ticket")
+    }
 
-            //should handle timeout and check the return id here
-            //discard lower order id
-            _, reply, err := edge.downLinkConn.ReadMessage()
-            if err != nil {
-                log.Println("read reply failed:", err)
-                removeConn(edgenode_id)
-                return
-            }
+    var ticket PLACEMENT_TICKET
+    err = json.Unmarshal(payload, &ticket)
+    if err != nil {
+        return errors.New("invalid placement ticket")
+    }
 
-            log.Println("recv:", reply, "from", edgenode_id)
-        }
+    if time.Now().Unix() >= ticket.Expire {
+        return errors.New("placement ticket expired")
     }
+    if ticket.EdgeNodeID != r.Header.Get("edgenode_id") ||
+        ticket.ProjectID != r.Header.Get("project_id") {
+        return errors.New("placement ticket not issued for this edge node")
+    }
+    if ticket.EdgeAccess != conf.Host + ":" + conf.Port {
+        return errors.New("placement ticket not issued for this edgeaccess")
+    }
+    return nil
 }
 
-func removeConn(edgenode_id string) {
-    edge := mapSession[edgenode_id]
-    if edge == nil { return }
+var (
+    errDownLinkTimeout   = errors.New("downlink request timeout")
+    errDownLinkClosed    = errors.New("downlink closed")
+    errDownLinkQueueFull = errors.New("downlink queue full")
+)
 
-    edge.downLinkConn.Close()
-    edge.upLinkConn.Close()
-    close(edge.downLinkCH)
-    close(edge.upLinkCH)
-    delete(mapSession, edgenode_id)
-}
+const (
+    OVERFLOW_REJECT      = "reject"
+    OVERFLOW_DROP_OLDEST = "drop_oldest"
+)
 
-func handleSync2EdgeAccess(w http.ResponseWriter, r *http.Request) {
+func downLinkTimeout() time.Duration {
+    if conf.DownLinkTimeout <= 0 {
+        return 10*time.Second
+    }
+    return time.Duration(conf.DownLinkTimeout)*time.Second
+}
 
-    edgenode_id := r.Header.Get("edgenode_id")
-    log.Println("handleSync2EdgeAccess...", edgenode_id)
+func maxCommandTimeout() time.Duration {
+    if conf.MaxCommandTimeout <= 0 {
+        return 60*time.Second
+    }
+    return time.Duration(conf.MaxCommandTimeout)*time.Second
+}
 
-    upgrader := websocket.Upgrader{}
-    conn, err := upgrader.Upgrade(w, r, nil)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
+// forwardTimeout covers the longest command forwarded to another EdgeAccess
+func forwardTimeout() time.Duration {
+    if maxCommandTimeout() > downLinkTimeout() {
+        return maxCommandTimeout()
     }
+    return downLinkTimeout()
+}
 
+func downLinkQueueDepth() int {
+    if conf.DownLinkQueueDepth <= 0 {
+        return 64
+    }
+    return conf.DownLinkQueueDepth
+}
 
-    //add the session to the map
-    if mapSession[edgenode_id] == nil {
-        newSession := new(CONN_SESSION)
-        mapSession[edgenode_id] = newSession
+func downLinkQueueTTL() time.Duration {
+    if conf.DownLinkQueueTTL <= 0 {
+        return 300*time.Second
     }
+    return time.Duration(conf.DownLinkQueueTTL)*time.Second
+}
 
-    //add the session to the map
-    mapSession[edgenode_id].upLinkConn = conn
-    mapSession[edgenode_id].upLinkCH   = make(chan MESSAGE)
+type queuedMessage struct {
+    msg    MESSAGE
+    expire time.Time
+    waited bool //a caller waits for the reply
+}
 
-    log.Println("Uplink for", edgenode_id, "established...")
+// DownLinkQueue holds the messages to one edge node until they are sent
+// by the handleDownLink worker of the session, or expired. It outlives
+// the sessions, so the messages to an offline edge node are delivered
+// when it attaches again
+type DownLinkQueue struct {
+    lock    sync.Mutex
+    items   []queuedMessage
+    notify  chan struct{} //signaled when a message is queued
 
-    go handleUpLink(edgenode_id)
-}
+    //the callers waiting for the replies, keyed by the message ID
+    pending map[uint64]chan MESSAGE
 
-func handleUpLink(edgenode_id string) {
+    workers int //handleDownLink workers of the sessions, guarded by DownLinkQueues
+}
 
-    edge, is_present := mapSession[edgenode_id]
-    if !is_present { return }
+// signal wakes up one worker without blocking
+func (q *DownLinkQueue) signal() {
+    select {
+    case q.notify <- struct{}{}:
+    default:
+    }
+}
 
-    defer func() {
-        if r := recover(); r != nil {
-            log.Println("Panic captured, removeConn in handleUpLink")
-            removeConn(edgenode_id)
-            return
+// dropExpired removes the expired messages, q.lock must be held
+func (q *DownLinkQueue) dropExpired(now time.Time) {
+    n := 0
+    for _, item := range q.items {
+        if now.Before(item.expire) {
+            q.items[n] = item
+            n++
+        } else {
+            log.Println("drop expired downlink message", item.msg.ID)
         }
-    }()
+    }
+    q.items = q.items[:n]
+}
 
-    for {
-        var inMsg MESSAGE
-        msgType, msg, err := edge.upLinkConn.ReadMessage()
-        if err != nil {
-            log.Println("edge.upLinkConn.ReadMessage failed", err)
-            removeConn(edgenode_id)
-            return
-        }
-        err = json.Unmarshal([]byte(msg), &inMsg)
-        inMsg.Reply = "touched by EdgeAccess at" + (time.Now()).Format("2006-01-02 15:04:05")
-        reply, _ := json.Marshal(&inMsg)
-        err = edge.upLinkConn.WriteMessage(msgType, []byte(string(reply)))
-        if err != nil {
-            log.Println("edge.upLinkConn.WriteMessage failed", err)
-            removeConn(edgenode_id)
-            return
-        }
-        log.Println("handleUpLink:", err, string(reply))
+// Pop returns the oldest message not expired
+func (q *DownLinkQueue) Pop() (queuedMessage, bool) {
+    q.lock.Lock()
+    defer q.lock.Unlock()
+
+    q.dropExpired(time.Now())
+    if len(q.items) == 0 {
+        return queuedMessage{}, false
     }
+    item := q.items[0]
+    q.items = q.items[1:]
+    return item, true
 }
 
+// PushFront puts back the message failed to send, it is sent first on
+// the next link. The message waited by a caller is dropped, the caller
+// is failed with the link and must not see it run later
+func (q *DownLinkQueue) PushFront(item queuedMessage) {
+    if item.waited {
+        log.Println("drop downlink message failed to send", item.msg.ID)
+        return
+    }
+    q.lock.Lock()
+    q.items = append([]queuedMessage{item}, q.items...)
+    q.lock.Unlock()
+    q.signal()
+}
 
-func handlePing2Edged(w http.ResponseWriter, r *http.Request) {
+func (q *DownLinkQueue) Len() int {
+    q.lock.Lock()
+    defer q.lock.Unlock()
+    return len(q.items)
+}
 
-    edgenode_id := r.URL.Query().Get("edgenode_id")
-    msg         := r.URL.Query().Get("msg")
+// dispatch hands the reply to the caller waiting for it, false if no one
+// waits, e.g. the request is timed out or nothing is waited
+func (q *DownLinkQueue) dispatch(reply MESSAGE) bool {
+    q.lock.Lock()
+    waiter := q.pending[reply.ID]
+    delete(q.pending, reply.ID)
+    q.lock.Unlock()
 
-    if edgenode_id == "" || msg == "" {
-        log.Println("invalid GET params:", edgenode_id, msg);
+    if waiter == nil {
+        return false
     }
-    log.Println("handlePing2Edged, GET params were:", edgenode_id, msg)
+    waiter <- reply
+    return true
+}
 
-    if mapSession[edgenode_id] == nil {
-        log.Println("this node not servered by me", edgenode_id);
-        return
+// forget drops the caller waiting for the reply, and the message if it's
+// not sent yet
+func (q *DownLinkQueue) forget(id uint64) {
+    q.lock.Lock()
+    delete(q.pending, id)
+    n := 0
+    for _, item := range q.items {
+        if item.msg.ID != id {
+            q.items[n] = item
+            n++
+        }
     }
-    edge := mapSession[edgenode_id]
+    q.items = q.items[:n]
+    q.lock.Unlock()
+}
 
-    defer func() {
-        if r := recover(); r != nil {
-            log.Println("Panic captured, removeConn in handlePing2Edged")
-            removeConn(edgenode_id)
-            return
-        }
-    }()
+// DownLinkQueues are the bounded downlink queues of the edge nodes, keyed
+// by edge node id
+type DownLinkQueues struct {
+    lock   sync.Mutex
+    items  map[string]*DownLinkQueue
+}
 
-    var newMsg MESSAGE
-    newMsg.ID        = newID()
-    newMsg.Body      = msg
-    newMsg.TimeStamp = time.Now().Unix()
-    newMsg.Reply     = "" //will be touched by the receiver
+func NewDownLinkQueues() *DownLinkQueues {
+    return &DownLinkQueues{items: make(map[string]*DownLinkQueue)}
+}
 
-    req, _ := json.Marshal(&newMsg)
-    err    := edge.downLinkConn.WriteMessage(websocket.TextMessage,
-                                             []byte(string(req)))
-    if err != nil {
-        log.Println("failed to write message to: edgenode_id",
-                    edgenode_id, "for req", string(req))
-        removeConn(edgenode_id)
-        return
+// get returns the queue of the edge node, created if not found, qs.lock
+// must be held
+func (qs *DownLinkQueues) get(edgenode_id string) *DownLinkQueue {
+    q := qs.items[edgenode_id]
+    if q == nil {
+        q = &DownLinkQueue{
+            notify:  make(chan struct{}, 1),
+            pending: make(map[uint64]chan MESSAGE),
+        }
+        qs.items[edgenode_id] = q
     }
+    return q
+}
 
-    log.Println("Ping msg to edgenode_id", edgenode_id,
-                "req", string(req))
+// Lookup returns the queue of the edge node, created if not found
+func (qs *DownLinkQueues) Lookup(edgenode_id string) *DownLinkQueue {
+    qs.lock.Lock()
+    defer qs.lock.Unlock()
+    return qs.get(edgenode_id)
+}
 
-    //should handle timeout and check the return id here
-    //discard lower order id
-    _, reply, err := edge.downLinkConn.ReadMessage()
-    if err != nil {
-        log.Println("read ping reply failed:", err)
-        removeConn(edgenode_id)
-        return
+// Push queues the message until expire, the waiter if not nil gets the
+// reply. When the queue is full, the oldest message is dropped for the
+// "drop_oldest" downlink_overflow, otherwise the message is rejected
+func (qs *DownLinkQueues) Push(edgenode_id string, msg MESSAGE, expire time.Time,
+                               waiter chan MESSAGE) (*DownLinkQueue, error) {
+    qs.lock.Lock()
+    defer qs.lock.Unlock()
+
+    q := qs.get(edgenode_id)
+
+    q.lock.Lock()
+    q.dropExpired(time.Now())
+    if len(q.items) >= downLinkQueueDepth() {
+        if conf.DownLinkOverflow != OVERFLOW_DROP_OLDEST {
+            q.lock.Unlock()
+            return nil, errDownLinkQueueFull
+        }
+        log.Println("downlink queue full, drop oldest message to",
+                    edgenode_id, q.items[0].msg.ID)
+        q.items = q.items[1:]
     }
+    q.items = append(q.items, queuedMessage{msg: msg, expire: expire,
+                                            waited: waiter != nil})
+    if waiter != nil {
+        q.pending[msg.ID] = waiter
+    }
+    q.lock.Unlock()
 
-    io.WriteString(w, "Reply from " + edgenode_id + " is "+ string(reply))
-    log.Println("Ping resp", edgenode_id, string(reply))
+    q.signal()
+    return q, nil
 }
 
-type EDGEACCESS_PING struct {
-    ConnNum        int    `json:"conn_num"`
-    Host           string `json:"host"`
-    Port           string `json:"port"`
-    ToEdged        string `json:"toedged_path"`
-    ToEdgeAccess   string `json:"toedgeaccess_path"`
-    BiAsync        string `json:"biasync_path"`
-}
+// Attach returns the queue for the worker of the session, the queue is
+// kept while it has workers
+func (qs *DownLinkQueues) Attach(edgenode_id string) *DownLinkQueue {
+    qs.lock.Lock()
+    defer qs.lock.Unlock()
 
+    q := qs.get(edgenode_id)
+    q.workers++
+    return q
+}
 
-func handlePing(w http.ResponseWriter, r *http.Request) {
+// Release is called by the worker exited, and wakes up the worker of the
+// new session if any
+func (qs *DownLinkQueues) Release(q *DownLinkQueue) {
+    qs.lock.Lock()
+    q.workers--
+    qs.lock.Unlock()
 
-    log.Println("hanldePing...")
+    q.signal()
+}
 
-    pingRsp := EDGEACCESS_PING{}
-    pingRsp.ConnNum       = len(mapSession)
+// Purge drops the expired messages, and removes the queues empty and not
+// used by any worker or caller
+func (qs *DownLinkQueues) Purge() {
+    qs.lock.Lock()
+    defer qs.lock.Unlock()
+
+    now := time.Now()
+    for edgenode_id, q := range qs.items {
+        q.lock.Lock()
+        q.dropExpired(now)
+        unused := len(q.items) == 0 && len(q.pending) == 0 && q.workers == 0
+        q.lock.Unlock()
+
+        if unused {
+            delete(qs.items, edgenode_id)
+        }
+    }
+}
+
+// Stranded returns the edge nodes with messages queued but no worker, i.e.
+// not attached to this EdgeAccess
+func (qs *DownLinkQueues) Stranded() []string {
+    qs.lock.Lock()
+    defer qs.lock.Unlock()
+
+    ids := make([]string, 0)
+    for edgenode_id, q := range qs.items {
+        q.lock.Lock()
+        if q.workers == 0 && len(q.items) > 0 {
+            ids = append(ids, edgenode_id)
+        }
+        q.lock.Unlock()
+    }
+    return ids
+}
+
+// Take removes the messages queued to the edge node not attached, for the
+// hand off to the EdgeAccess it attached to. The ones waited by a caller
+// are left
+func (qs *DownLinkQueues) Take(edgenode_id string) []queuedMessage {
+    qs.lock.Lock()
+    defer qs.lock.Unlock()
+
+    q := qs.items[edgenode_id]
+    if q == nil || q.workers > 0 {
+        return nil
+    }
+
+    q.lock.Lock()
+    defer q.lock.Unlock()
+
+    q.dropExpired(time.Now())
+    taken := make([]queuedMessage, 0, len(q.items))
+    n := 0
+    for _, item := range q.items {
+        if _, waited := q.pending[item.msg.ID]; waited {
+            q.items[n] = item
+            n++
+        } else {
+            taken = append(taken, item)
+        }
+    }
+    q.items = q.items[:n]
+    return taken
+}
+
+// Restore puts back the messages failed to hand off, before the others
+func (qs *DownLinkQueues) Restore(edgenode_id string, items []queuedMessage) {
+    qs.lock.Lock()
+    q := qs.get(edgenode_id)
+    qs.lock.Unlock()
+
+    q.lock.Lock()
+    q.items = append(append([]queuedMessage{}, items...), q.items...)
+    q.lock.Unlock()
+    q.signal()
+}
+
+func purgeLoop() {
+    for {
+        time.Sleep(30*time.Second)
+        queues.Purge()
+    }
+}
+
+// Request queues the message and waits for the reply of the same ID, many
+// requests can be in flight to one edge node. The message not sent before
+// the timeout is dropped, errDownLinkClosed is returned if the downlink
+// is closed before the reply, i.e. done is closed, and the message is
+// never sent after Request returns
+func (qs *DownLinkQueues) Request(edgenode_id string, done chan struct{},
+                                  msg MESSAGE, timeout time.Duration) (MESSAGE, error) {
+
+    waiter := make(chan MESSAGE, 1)
+    q, err := qs.Push(edgenode_id, msg, time.Now().Add(timeout), waiter)
+    if err != nil {
+        return MESSAGE{}, err
+    }
+    defer q.forget(msg.ID)
+
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+
+    select {
+    case reply := <-waiter:
+        return reply, nil
+    case <-done:
+        return MESSAGE{}, errDownLinkClosed
+    case <-timer.C:
+        return MESSAGE{}, errDownLinkTimeout
+    }
+}
+
+// handleDownLink is the only writer of the downlink, it drains the queue
+// of the edge node in order until the downlink is replaced or closed,
+// i.e. done is closed. The message failed to send is put back for the
+// next link, unless a caller waits for it
+func handleDownLink(edgenode_id string, edge *CONN_SESSION,
+                    conn *websocket.Conn, done chan struct{}) {
+
+    q := queues.Attach(edgenode_id)
+    defer queues.Release(q)
+
+    for {
+        for {
+            select {
+            case <-done:
+                return
+            default:
+            }
+
+            item, ok := q.Pop()
+            if !ok {
+                break
+            }
+
+            req, _ := json.Marshal(item.msg)
+            conn.SetWriteDeadline(time.Now().Add(downLinkTimeout()))
+            err    := conn.WriteMessage(websocket.TextMessage,
+                                                     []byte(string(req)))
+            if err != nil {
+                log.Println("failed to write message to: edgenode_id",
+                            edgenode_id, "for req", string(req))
+                q.PushFront(item)
+                removeLink(edgenode_id, edge, conn)
+                return
+            }
+
+            log.Println("Send msg to downlink: edgenode_id", edgenode_id,
+                        "req", string(req))
+        }
+
+        select {
+        case <-q.notify:
+        case <-done:
+            return
+        }
+    }
+}
+
+// readDownLink dispatches the replies on the downlink to the callers
+// waiting for the same message ID, the others are logged and discarded
+func readDownLink(edgenode_id string, edge *CONN_SESSION, conn *websocket.Conn) {
+
+    for {
+        _, reply, err := conn.ReadMessage()
+        if err != nil {
+            log.Println("read reply failed:", edgenode_id, err)
+            removeLink(edgenode_id, edge, conn)
+            return
+        }
+
+        var replyMsg MESSAGE
+        err = json.Unmarshal(reply, &replyMsg)
+        if err != nil {
+            log.Println("decode reply failed:", edgenode_id, err)
+            continue
+        }
+
+        if !queues.Lookup(edgenode_id).dispatch(replyMsg) {
+            log.Println("discard reply not waited from", edgenode_id, string(reply))
+        }
+    }
+}
+
+// removeLink detaches and closes the failed link, and the session with its
+// last link. Nothing is done if the link is replaced or removed already.
+// The edge node is detached from the node directory with its downlink
+func removeLink(edgenode_id string, edge *CONN_SESSION, conn *websocket.Conn) {
+    downLink, _ := sessions.DownLink(edgenode_id)
+    removed, last := sessions.DetachLink(edgenode_id, edge, conn)
+    if !removed {
+        return
+    }
+    if conn == downLink {
+        reportDirectory(edgenode_id, DIRECTORY_DETACH)
+    }
+    if last {
+        closeSession(edge)
+    }
+}
+
+// closeSession closes the channels of the session removed with its last
+// link
+func closeSession(edge *CONN_SESSION) {
+    if edge.upLinkCH != nil {
+        close(edge.upLinkCH)
+    }
+    close(edge.done)
+}
+
+func handleSync2EdgeAccess(w http.ResponseWriter, r *http.Request) {
+
+    edgenode_id := r.Header.Get("edgenode_id")
+    log.Println("handleSync2EdgeAccess...", edgenode_id)
+
+    err := verifyTicket(r)
+    if err != nil {
+        log.Println("handleSync2EdgeAccess rejected", edgenode_id, err)
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    // placement may send more edged than max_conn with a stale view
+    if !sessions.Admit(edgenode_id, conf.MaxConn) {
+        log.Println("handleSync2EdgeAccess refused", edgenode_id, "max_conn reached")
+        http.Error(w, "EdgeAccess reaches max_conn", http.StatusServiceUnavailable)
+        return
+    }
+
+    upgrader := websocket.Upgrader{}
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    //add the uplink to the session, the stale uplink is closed
+    edge, _ := sessions.AttachUpLink(edgenode_id, nodeIdentity(r), conn)
+
+    log.Println("Uplink for", edgenode_id, "established...")
+
+    go handleUpLink(edgenode_id, edge, conn)
+}
+
+func handleUpLink(edgenode_id string, edge *CONN_SESSION, conn *websocket.Conn) {
+
+    defer func() {
+        if r := recover(); r != nil {
+            log.Println("Panic captured, removeLink in handleUpLink")
+            removeLink(edgenode_id, edge, conn)
+            return
+        }
+    }()
+
+    for {
+        var inMsg MESSAGE
+        msgType, msg, err := conn.ReadMessage()
+        if err != nil {
+            log.Println("edge.upLinkConn.ReadMessage failed", err)
+            removeLink(edgenode_id, edge, conn)
+            return
+        }
+        err = json.Unmarshal([]byte(msg), &inMsg)
+        var replyMsg MESSAGE
+        if err != nil {
+            replyMsg = newErrorReply(&inMsg, http.StatusBadRequest, err)
+        } else {
+            replyMsg = dispatchTopic(edgenode_id, &inMsg)
+        }
+        reply, _ := json.Marshal(&replyMsg)
+        err = conn.WriteMessage(msgType, []byte(string(reply)))
+        if err != nil {
+            log.Println("edge.upLinkConn.WriteMessage failed", err)
+            removeLink(edgenode_id, edge, conn)
+            return
+        }
+        log.Println("handleUpLink:", err, string(reply))
+    }
+}
+
+
+func handlePing2Edged(w http.ResponseWriter, r *http.Request) {
+
+    edgenode_id := r.URL.Query().Get("edgenode_id")
+    msg         := r.URL.Query().Get("msg")
+
+    if edgenode_id == "" || msg == "" {
+        log.Println("invalid GET params:", edgenode_id, msg);
+    }
+    log.Println("handlePing2Edged, GET params were:", edgenode_id, msg)
+
+    downLinkConn, done := sessions.DownLink(edgenode_id)
+    if downLinkConn == nil {
+        // ask the node directory which EdgeAccess owns it
+        if routeToOwner(w, r, edgenode_id) {
+            return
+        }
+        log.Println("this node not servered by me", edgenode_id);
+        http.Error(w, "edge node not attached", http.StatusNotFound)
+        return
+    }
+
+    newMsg := newRequest(TOPIC_PING)
+    newMsg.Body = msg
+
+    log.Println("Ping msg to edgenode_id", edgenode_id, "id", newMsg.ID)
+
+    replyMsg, err := queues.Request(edgenode_id, done, newMsg, downLinkTimeout())
+    if err == errDownLinkTimeout {
+        log.Println("ping reply timeout:", edgenode_id, newMsg.ID)
+        http.Error(w, err.Error(), http.StatusGatewayTimeout)
+        return
+    }
+    if err == errDownLinkQueueFull {
+        log.Println("ping rejected:", edgenode_id, err)
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    if err != nil {
+        log.Println("ping failed:", edgenode_id, err)
+        http.Error(w, err.Error(), http.StatusBadGateway)
+        return
+    }
+
+    reply, _ := json.Marshal(&replyMsg)
+    io.WriteString(w, "Reply from " + edgenode_id + " is "+ string(reply))
+    log.Println("Ping resp", edgenode_id, string(reply))
+}
+
+// events queued on the BiAsync link of a session before dropping
+const BIASYNC_QUEUE = 256
+
+var errBiAsyncFull = errors.New("biasync queue full")
+
+func handleBiAsync(w http.ResponseWriter, r *http.Request) {
+
+    edgenode_id := r.Header.Get("edgenode_id")
+    log.Println("handleBiAsync...", edgenode_id)
+
+    err := verifyTicket(r)
+    if err != nil {
+        log.Println("handleBiAsync rejected", edgenode_id, err)
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    // placement may send more edged than max_conn with a stale view
+    if !sessions.Admit(edgenode_id, conf.MaxConn) {
+        log.Println("handleBiAsync refused", edgenode_id, "max_conn reached")
+        http.Error(w, "EdgeAccess reaches max_conn", http.StatusServiceUnavailable)
+        return
+    }
+
+    upgrader := websocket.Upgrader{}
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    //add the BiAsync link to the session, the stale BiAsync link is closed
+    edge, done := sessions.AttachBiAsync(edgenode_id, nodeIdentity(r), conn)
+
+    log.Println("BiAsync link for", edgenode_id, "established...")
+
+    go writeBiAsync(edgenode_id, edge, conn, done)
+    go readBiAsync(edgenode_id, edge, conn)
+}
+
+// writeBiAsync sends the queued events on the BiAsync link until it is
+// replaced or closed, nothing is waited from edged
+func writeBiAsync(edgenode_id string, edge *CONN_SESSION,
+                  conn *websocket.Conn, done chan struct{}) {
+
+    for {
+        select {
+        case e := <-edge.biAsyncCH:
+            event, _ := json.Marshal(&e)
+            conn.SetWriteDeadline(time.Now().Add(downLinkTimeout()))
+            err := conn.WriteMessage(websocket.TextMessage, event)
+            if err != nil {
+                log.Println("write biasync failed:", edgenode_id, err)
+                removeLink(edgenode_id, edge, conn)
+                return
+            }
+        case <-done:
+            return
+        }
+    }
+}
+
+// readBiAsync hands the events from edged to the handler of the topic as
+// the messages of the uplink, nothing is replied
+func readBiAsync(edgenode_id string, edge *CONN_SESSION, conn *websocket.Conn) {
+
+    for {
+        _, msg, err := conn.ReadMessage()
+        if err != nil {
+            log.Println("read biasync failed:", edgenode_id, err)
+            removeLink(edgenode_id, edge, conn)
+            return
+        }
+
+        var e ASYNC_EVENT
+        err = json.Unmarshal(msg, &e)
+        if err != nil {
+            log.Println("decode biasync event failed:", edgenode_id, err)
+            continue
+        }
+
+        inMsg := MESSAGE{Version: MESSAGE_VERSION, Type: MSG_REQUEST,
+                         Topic: e.Topic, TimeStamp: e.TimeStamp, Body: e.Body}
+        reply := dispatchTopic(edgenode_id, &inMsg)
+        if reply.Type == MSG_ERROR {
+            log.Println("biasync event dropped from", edgenode_id, reply.Error, string(msg))
+        }
+    }
+}
+
+func handleNotificationMsg(edgenode_id string, in *MESSAGE) MESSAGE {
+    log.Println("notification from", edgenode_id, in.Body)
+    return newReply(in)
+}
+
+// publishAsync2Edged queues the event to the BiAsync link of the edge
+// node without waiting, the event is dropped if the queue is full
+func publishAsync2Edged(edge *CONN_SESSION, topic string, body string) error {
+
+    e := ASYNC_EVENT{Topic: topic, TimeStamp: time.Now().Unix(), Body: body}
+    select {
+    case edge.biAsyncCH <- e:
+        return nil
+    case <-edge.done:
+        return errDownLinkClosed
+    default:
+        return errBiAsyncFull
+    }
+}
+
+// handleAsync2Edged publishes the request body as an event of the topic
+// to the edge node
+func handleAsync2Edged(w http.ResponseWriter, r *http.Request) {
+
+    if r.Method != "POST" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+
+    edgenode_id := r.URL.Query().Get("edgenode_id")
+    topic       := r.URL.Query().Get("topic")
+    if edgenode_id == "" || topic == "" {
+        http.Error(w, "edgenode_id and topic required", 400)
+        return
+    }
+
+    edge, biAsyncLinkConn := sessions.BiAsync(edgenode_id)
+    if biAsyncLinkConn == nil {
+        // ask the node directory which EdgeAccess owns it
+        if routeToOwner(w, r, edgenode_id) {
+            return
+        }
+        http.Error(w, "no biasync link to " + edgenode_id, http.StatusNotFound)
+        return
+    }
+
+    body, err := ioutil.ReadAll(r.Body)
+    if err != nil {
+        http.Error(w, err.Error(), 400)
+        return
+    }
+
+    err = publishAsync2Edged(edge, topic, string(body))
+    if err != nil {
+        log.Println("publish async failed:", edgenode_id, topic, err)
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    w.WriteHeader(http.StatusAccepted)
+}
+
+// COMMAND is sent to edged on the downlink, and waited for the reply
+type COMMAND struct {
+    Topic          string          `json:"topic"` //"command" if not set
+    ContentType    string          `json:"content_type"`
+    Payload        json.RawMessage `json:"payload"`
+    Body           string          `json:"body"`
+    Timeout        int             `json:"timeout"` //seconds, downlink_timeout if not set, at most max_command_timeout
+}
+
+// COMMAND_RESULT is the reply of edged to the command, or the error
+type COMMAND_RESULT struct {
+    EdgeNodeID     string   `json:"edgenode_id"`
+    ID             uint64   `json:"id,omitempty"`
+    Reply          *MESSAGE `json:"reply,omitempty"`
+    Error          string   `json:"error,omitempty"`
+}
+
+var (
+    errNotAttached   = errors.New("edge node not attached")
+    errCommandFailed = errors.New("command failed on edge node")
+)
+
+// commandStatus maps the error of the command to the http status
+func commandStatus(err error) int {
+    switch err {
+    case nil:
+        return http.StatusOK
+    case errNotAttached:
+        return http.StatusNotFound
+    case errDownLinkTimeout:
+        return http.StatusGatewayTimeout
+    case errDownLinkQueueFull:
+        return http.StatusServiceUnavailable
+    case errCommandFailed:
+        return http.StatusUnprocessableEntity
+    }
+    return http.StatusBadGateway
+}
+
+// sendCommand sends the command to the edge node attached and waits for
+// the reply
+func sendCommand(edgenode_id string, cmd *COMMAND) (COMMAND_RESULT, error) {
+
+    result := COMMAND_RESULT{EdgeNodeID: edgenode_id}
+
+    downLinkConn, done := sessions.DownLink(edgenode_id)
+    if downLinkConn == nil {
+        result.Error = errNotAttached.Error()
+        return result, errNotAttached
+    }
+
+    // the timeout from the client holds a goroutine and a pending slot,
+    // so it's bounded by max_command_timeout
+    timeout := downLinkTimeout()
+    if cmd.Timeout > 0 {
+        timeout = time.Duration(cmd.Timeout)*time.Second
+    }
+    if timeout > maxCommandTimeout() {
+        timeout = maxCommandTimeout()
+    }
+
+    topic := cmd.Topic
+    if topic == "" {
+        topic = TOPIC_COMMAND
+    }
+    newMsg := newRequest(topic)
+    newMsg.Body        = cmd.Body
+    newMsg.ContentType = cmd.ContentType
+    newMsg.Payload     = cmd.Payload
+
+    result.ID = newMsg.ID
+    reply, err := queues.Request(edgenode_id, done, newMsg, timeout)
+    if err != nil {
+        result.Error = err.Error()
+        return result, err
+    }
+    result.Reply = &reply
+    if reply.Type == MSG_ERROR {
+        result.Error = reply.Error
+        return result, errCommandFailed
+    }
+    return result, nil
+}
+
+// handleEdgedCommands serves POST /v1.0/edged/{edgenode_id}/commands, the
+// command in json is sent to edged, and the reply of edged is returned in
+// json. 404 is returned if the edge node is not attached, 504 on timeout,
+// 502 if the link failed, and 422 if edged replies an error
+func handleEdgedCommands(w http.ResponseWriter, r *http.Request) {
+
+    parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1.0/edged/"), "/")
+    if len(parts) != 2 || parts[0] == "" || parts[1] != "commands" {
+        http.NotFound(w, r)
+        return
+    }
+    edgenode_id := parts[0]
+
+    if r.Method != "POST" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+
+    var cmd COMMAND
+    err := json.NewDecoder(r.Body).Decode(&cmd)
+    if err != nil {
+        http.Error(w, err.Error(), 400)
+        return
+    }
+
+    result, err := sendCommand(edgenode_id, &cmd)
+    if err == errNotAttached {
+        // ask the node directory which EdgeAccess owns it, the command
+        // is encoded again as the body is read
+        bytesBody, _ := json.Marshal(&cmd)
+        r.Body = ioutil.NopCloser(bytes.NewReader(bytesBody))
+        if routeToOwner(w, r, edgenode_id) {
+            return
+        }
+    }
+    if err != nil {
+        log.Println("command to", edgenode_id, "failed:", err)
+    }
+
+    w.Header().Set("Content-Type","application/json")
+    w.WriteHeader(commandStatus(err))
+    json.NewEncoder(w).Encode(&result)
+}
+
+// SELECTOR selects the edge nodes attached by all the fields set
+type SELECTOR struct {
+    ProjectID      string            `json:"project_id"`
+    EdgeNodeIDs    []string          `json:"edgenode_ids"`
+    Labels         map[string]string `json:"labels"`
+}
+
+func (sel *SELECTOR) Empty() bool {
+    return sel.ProjectID == "" && len(sel.EdgeNodeIDs) == 0 && len(sel.Labels) == 0
+}
+
+func (sel *SELECTOR) Match(edgenode_id string, ident *NODE_IDENTITY) bool {
+    if sel.ProjectID != "" && sel.ProjectID != ident.ProjectID {
+        return false
+    }
+    if len(sel.EdgeNodeIDs) > 0 {
+        found := false
+        for _, id := range sel.EdgeNodeIDs {
+            if id == edgenode_id {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    for k, v := range sel.Labels {
+        if ident.Labels[k] != v {
+            return false
+        }
+    }
+    return true
+}
+
+// FANOUT_COMMAND is the command sent to the edge nodes selected
+type FANOUT_COMMAND struct {
+    Selector       SELECTOR `json:"selector"`
+    COMMAND
+}
+
+type FANOUT_RESULT struct {
+    Matched        int              `json:"matched"`
+    Succeeded      []COMMAND_RESULT `json:"succeeded"`
+    Failed         []COMMAND_RESULT `json:"failed"`
+    TimedOut       []COMMAND_RESULT `json:"timed_out"`
+
+    //some edge nodes may be missed, the EdgeAccess not queried are listed
+    Partial        bool             `json:"partial,omitempty"`
+    Unqueried      []string         `json:"unqueried,omitempty"`
+}
+
+func fanOutConcurrency() int {
+    if conf.FanOutConcurrency <= 0 {
+        return 64
+    }
+    return conf.FanOutConcurrency
+}
+
+// fanOutCommand sends the command to the edge nodes concurrently, at most
+// fanout_concurrency in flight, and collects the results in their order
+func fanOutCommand(ids []string, cmd *COMMAND) *FANOUT_RESULT {
+
+    results := make([]COMMAND_RESULT, len(ids))
+    errs    := make([]error, len(ids))
+
+    var wg sync.WaitGroup
+    sem := make(chan struct{}, fanOutConcurrency())
+    for i, edgenode_id := range ids {
+        wg.Add(1)
+        sem <- struct{}{}
+        go func(i int, edgenode_id string) {
+            defer wg.Done()
+            defer func() { <-sem }()
+            results[i], errs[i] = sendCommand(edgenode_id, cmd)
+        }(i, edgenode_id)
+    }
+    wg.Wait()
+
+    fanOut := &FANOUT_RESULT{
+        Matched:   len(ids),
+        Succeeded: make([]COMMAND_RESULT, 0),
+        Failed:    make([]COMMAND_RESULT, 0),
+        TimedOut:  make([]COMMAND_RESULT, 0),
+    }
+    for i := range ids {
+        switch errs[i] {
+        case nil:
+            fanOut.Succeeded = append(fanOut.Succeeded, results[i])
+        case errDownLinkTimeout:
+            fanOut.TimedOut = append(fanOut.TimedOut, results[i])
+        default:
+            fanOut.Failed = append(fanOut.Failed, results[i])
+        }
+    }
+    return fanOut
+}
+
+// handleFanOutCommands serves POST /v1.0/commands, the command is sent to
+// the edge nodes selected by the project id, the list of edge node ids and
+// the labels. The edge nodes listed but attached to another EdgeAccess are
+// forwarded to it by the node directory, the ones not attached anywhere or
+// not matching the selector are reported as failed. Without edgenode_ids
+// the selector is forwarded to every EdgeAccess in the node directory, and
+// the result is partial if any of them can't be queried
+func handleFanOutCommands(w http.ResponseWriter, r *http.Request) {
+
+    if r.Method != "POST" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+
+    var cmd FANOUT_COMMAND
+    err := json.NewDecoder(r.Body).Decode(&cmd)
+    if err != nil {
+        http.Error(w, err.Error(), 400)
+        return
+    }
+    if cmd.Selector.Empty() {
+        http.Error(w, "empty selector", 400)
+        return
+    }
+
+    ids := sessions.Select(&cmd.Selector)
+    selected := make(map[string]bool, len(ids))
+    for _, edgenode_id := range ids {
+        selected[edgenode_id] = true
+    }
+
+    // the listed edge nodes not selected here
+    failed := make([]COMMAND_RESULT, 0)
+    remote := make([]string, 0)
+    for _, edgenode_id := range cmd.Selector.EdgeNodeIDs {
+        if selected[edgenode_id] {
+            continue
+        }
+        edge := sessions.Get(edgenode_id)
+        if edge == nil {
+            remote = append(remote, edgenode_id)
+            continue
+        }
+        reason := errNotAttached.Error()
+        if !cmd.Selector.Match(edgenode_id, &edge.ident) {
+            reason = "not matching the project_id or labels"
+        }
+        failed = append(failed, COMMAND_RESULT{EdgeNodeID: edgenode_id, Error: reason})
+    }
+
+    // forwarded already, the edge nodes not here are not looked up again
+    listed  := len(cmd.Selector.EdgeNodeIDs) > 0
+    partial := false
+    owners  := make(map[string][]string)
+    if conf.PlacementURL == "" || r.Header.Get("forwarded_by") != "" {
+        for _, edgenode_id := range remote {
+            failed = append(failed, COMMAND_RESULT{EdgeNodeID: edgenode_id,
+                                                   Error: errNotAttached.Error()})
+        }
+    } else if listed {
+        owners, failed = resolveOwners(remote, failed)
+    } else {
+        owners, err = listOwners()
+        if err != nil {
+            log.Println("list node directory failed:", err)
+            partial = true
+        }
+    }
+    log.Println("fan-out command to", len(ids), "edge nodes,",
+                len(owners), "other EdgeAccess,", len(failed), "failed")
+
+    // the other EdgeAccess work in parallel with this one
+    var wg sync.WaitGroup
+    var lock sync.Mutex
+    forwarded := make([]*FANOUT_RESULT, 0, len(owners))
+    for owner, group := range owners {
+        wg.Add(1)
+        go func(owner string, group []string) {
+            defer wg.Done()
+            result := forwardFanOut(owner, group, listed, &cmd)
+            lock.Lock()
+            forwarded = append(forwarded, result)
+            lock.Unlock()
+        }(owner, group)
+    }
+
+    result := fanOutCommand(ids, &cmd.COMMAND)
+    wg.Wait()
+    for _, f := range forwarded {
+        result.Matched  += f.Matched
+        result.Succeeded = append(result.Succeeded, f.Succeeded...)
+        result.Failed    = append(result.Failed, f.Failed...)
+        result.TimedOut  = append(result.TimedOut, f.TimedOut...)
+        result.Unqueried = append(result.Unqueried, f.Unqueried...)
+    }
+    result.Failed  = append(result.Failed, failed...)
+    result.Partial = partial || len(result.Unqueried) > 0
+
+    w.Header().Set("Content-Type","application/json")
+    json.NewEncoder(w).Encode(&result)
+}
+
+// resolveOwners groups the edge nodes by the EdgeAccess owning them, the
+// ones not found in the node directory are added to failed
+func resolveOwners(ids []string, failed []COMMAND_RESULT) (map[string][]string, []COMMAND_RESULT) {
+    homes := make([]string, len(ids))
+
+    var wg sync.WaitGroup
+    sem := make(chan struct{}, fanOutConcurrency())
+    for i, edgenode_id := range ids {
+        wg.Add(1)
+        sem <- struct{}{}
+        go func(i int, edgenode_id string) {
+            defer wg.Done()
+            defer func() { <-sem }()
+            homes[i], _ = lookupDirectory(edgenode_id)
+        }(i, edgenode_id)
+    }
+    wg.Wait()
+
+    owners := make(map[string][]string)
+    for i, edgenode_id := range ids {
+        if homes[i] == "" || homes[i] == selfHome() {
+            failed = append(failed, COMMAND_RESULT{EdgeNodeID: edgenode_id,
+                                                   Error: errNotAttached.Error()})
+            continue
+        }
+        owners[homes[i]] = append(owners[homes[i]], edgenode_id)
+    }
+    return owners, failed
+}
+
+// listOwners groups the edge nodes in the node directory by the other
+// EdgeAccess owning them
+func listOwners() (map[string][]string, error) {
+    req, err := http.NewRequest("GET", conf.PlacementURL+"/v1.0/directory", nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Add("admin_token", conf.AdminToken)
+
+    client := &http.Client{Timeout: 5 * time.Second}
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != 200 {
+        return nil, errors.New("directory list " + resp.Status)
+    }
+    var entries []DirectoryEntry
+    err = json.NewDecoder(resp.Body).Decode(&entries)
+    if err != nil {
+        return nil, err
+    }
+
+    owners := make(map[string][]string)
+    for _, entry := range entries {
+        if entry.EdgeAccessHome == "" || entry.EdgeAccessHome == selfHome() {
+            continue
+        }
+        owners[entry.EdgeAccessHome] = append(owners[entry.EdgeAccessHome], entry.EdgeNodeID)
+    }
+    return owners, nil
+}
+
+// forwardFanOut sends the command to the edge nodes attached to the owner,
+// the listed ones or the ones selected there. If the owner can't be
+// reached the listed ones are reported as failed, or the owner is reported
+// as unqueried
+func forwardFanOut(owner string, ids []string, listed bool, cmd *FANOUT_COMMAND) *FANOUT_RESULT {
+    result, err := postFanOut(owner, ids, listed, cmd)
+    if err == nil {
+        return result
+    }
+
+    log.Println("forward fan-out to", owner, "failed:", err)
+    if !listed {
+        return &FANOUT_RESULT{Unqueried: []string{owner}}
+    }
+    result = &FANOUT_RESULT{Failed: make([]COMMAND_RESULT, 0, len(ids))}
+    for _, edgenode_id := range ids {
+        result.Failed = append(result.Failed, COMMAND_RESULT{EdgeNodeID: edgenode_id,
+                               Error: "forward to " + owner + " failed"})
+    }
+    return result
+}
+
+// postFanOut forwards the command, the edge nodes in the directory of the
+// owner only bound the time waited if they are not listed
+func postFanOut(owner string, ids []string, listed bool, cmd *FANOUT_COMMAND) (*FANOUT_RESULT, error) {
+    sub := *cmd
+    if listed {
+        sub.Selector.EdgeNodeIDs = ids
+    }
+
+    bytesBody, err := json.Marshal(&sub)
+    if err != nil {
+        return nil, err
+    }
+    req, err := http.NewRequest("POST", owner+"/v1.0/commands",
+                                bytes.NewBuffer(bytesBody))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("forwarded_by", selfHome())
+
+    // the owner sends at most fanout_concurrency commands at a time
+    rounds := (len(ids) + fanOutConcurrency() - 1) / fanOutConcurrency()
+    client := &http.Client{Timeout: forwardTimeout()*time.Duration(rounds)}
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, errors.New("fan-out " + resp.Status)
+    }
+    var result FANOUT_RESULT
+    err = json.NewDecoder(resp.Body).Decode(&result)
+    if err != nil {
+        return nil, err
+    }
+    return &result, nil
+}
+
+type SEND_RESULT struct {
+    ID             uint64 `json:"id"`
+    Queued         int    `json:"queued"` //messages queued to the edge node
+    Attached       bool   `json:"attached"`
+}
+
+// handleSend2Edged queues the message to the edge node without waiting
+// for the reply. The message to an offline edge node is held for
+// downlink_queue_ttl seconds, and sent when it attaches again
+func handleSend2Edged(w http.ResponseWriter, r *http.Request) {
+
+    if r.Method != "POST" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+
+    edgenode_id := r.URL.Query().Get("edgenode_id")
+    msg         := r.URL.Query().Get("msg")
+    if edgenode_id == "" || msg == "" {
+        http.Error(w, "edgenode_id and msg required", 400)
+        return
+    }
+
+    downLinkConn, _ := sessions.DownLink(edgenode_id)
+    if downLinkConn == nil && routeToOwner(w, r, edgenode_id) {
+        return
+    }
+
+    topic := r.URL.Query().Get("topic")
+    if topic == "" {
+        topic = TOPIC_COMMAND
+    }
+    newMsg := newRequest(topic)
+    newMsg.Body = msg
+
+    q, err := queues.Push(edgenode_id, newMsg,
+                          time.Now().Add(downLinkQueueTTL()), nil)
+    if err != nil {
+        log.Println("send2edged rejected:", edgenode_id, err)
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    log.Println("queued msg to edgenode_id", edgenode_id, "id", newMsg.ID,
+                "attached", downLinkConn != nil)
+
+    result := SEND_RESULT{ID: newMsg.ID, Queued: q.Len(),
+                          Attached: downLinkConn != nil}
+    w.Header().Set("Content-Type","application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(&result)
+}
+
+// HANDOFF is the messages queued to an edge node attached to another
+// EdgeAccess, handed off to that one. TTL is the seconds left of each
+// message, so the clocks of the hosts are not compared
+type HANDOFF struct {
+    EdgeNodeID     string            `json:"edgenode_id"`
+    Messages       []HANDOFF_MESSAGE `json:"messages"`
+}
+
+type HANDOFF_MESSAGE struct {
+    Message        MESSAGE `json:"message"`
+    TTL            float64 `json:"ttl"`
+}
+
+// handoffLoop hands off the messages held for the offline edge nodes once
+// they attach to another EdgeAccess, e.g. after a failover, so they are
+// not stranded here until they expire
+func handoffLoop() {
+    interval := conf.RegisterInterval
+    if interval <= 0 {
+        interval = 5
+    }
+
+    for {
+        time.Sleep(time.Duration(interval)*time.Second)
+
+        for _, edgenode_id := range queues.Stranded() {
+            owner, err := lookupDirectory(edgenode_id)
+            if err != nil || owner == selfHome() {
+                continue
+            }
+
+            items := queues.Take(edgenode_id)
+            if len(items) == 0 {
+                continue
+            }
+            err = handoff(owner, edgenode_id, items)
+            if err != nil {
+                log.Println("handoff to", owner, "failed:", edgenode_id, err)
+                queues.Restore(edgenode_id, items)
+                continue
+            }
+            log.Println("handed off", len(items), "messages of", edgenode_id, "to", owner)
+        }
+    }
+}
+
+func handoff(owner string, edgenode_id string, items []queuedMessage) error {
+    now := time.Now()
+    h   := HANDOFF{EdgeNodeID: edgenode_id,
+                   Messages: make([]HANDOFF_MESSAGE, 0, len(items))}
+    for _, item := range items {
+        h.Messages = append(h.Messages, HANDOFF_MESSAGE{
+            Message: item.msg,
+            TTL:     item.expire.Sub(now).Seconds(),
+        })
+    }
+
+    bytesBody, err := json.Marshal(&h)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequest("POST", owner+"/v1.0/handoff", bytes.NewBuffer(bytesBody))
+    if err != nil {
+        return err
+    }
+    req.Header.Add("Content-Type", "application/json")
+    req.Header.Add("admin_token", conf.AdminToken)
+
+    client := &http.Client{Timeout: downLinkTimeout()}
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return errors.New("handoff " + resp.Status)
+    }
+    return nil
+}
+
+// handleHandoff queues the messages handed off by another EdgeAccess. They
+// get new IDs, the IDs of that EdgeAccess may clash with the ones here
+func handleHandoff(w http.ResponseWriter, r *http.Request) {
+
+    if r.Method != "POST" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+    if !checkAdminToken(w, r) {
+        return
+    }
+
+    var h HANDOFF
+    err := json.NewDecoder(r.Body).Decode(&h)
+    if err != nil {
+        http.Error(w, err.Error(), 400)
+        return
+    }
+    if h.EdgeNodeID == "" {
+        http.Error(w, "edgenode_id is required", 400)
+        return
+    }
+
+    now := time.Now()
+    for _, m := range h.Messages {
+        if m.TTL <= 0 {
+            continue
+        }
+        msg := m.Message
+        msg.ID = newID()
+        _, err = queues.Push(h.EdgeNodeID, msg,
+                             now.Add(time.Duration(m.TTL*float64(time.Second))), nil)
+        if err != nil {
+            log.Println("handoff message to", h.EdgeNodeID, "dropped:", err)
+        }
+    }
+    log.Println("received", len(h.Messages), "handed off messages of", h.EdgeNodeID)
+    w.WriteHeader(http.StatusOK)
+}
+
+// control message asking edged to reconnect via placement
+const CTRL_RECONNECT = "ctrl:reconnect_via_placement"
+
+type REBALANCE_RESULT struct {
+    Requested      int      `json:"requested"`
+    HandedBack     []string `json:"handed_back"`
+}
+
+// checkAdminToken answers 401 and returns false unless the admin_token
+// header matches the configured one, 403 if admin_token is not set
+func checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+    if conf.AdminToken == "" {
+        http.Error(w, "admin_token is not configured", 403)
+        return false
+    }
+    if !hmac.Equal([]byte(r.Header.Get("admin_token")), []byte(conf.AdminToken)) {
+        http.Error(w, "invalid admin_token", 401)
+        return false
+    }
+    return true
+}
+
+// handleRebalance is called by placement with the number of sessions
+// to hand back, the selected edged are asked to reconnect via placement
+func handleRebalance(w http.ResponseWriter, r *http.Request) {
+
+    if r.Method != "POST" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+    if !checkAdminToken(w, r) {
+        return
+    }
+
+    count, err := strconv.Atoi(r.URL.Query().Get("count"))
+    if err != nil || count <= 0 {
+        http.Error(w, "invalid count", 400)
+        return
+    }
+    log.Println("handleRebalance, count", count)
+
+    selected := make([]string, 0, count)
+    sessions.Range(func(edgenode_id string, edge *CONN_SESSION) bool {
+        if downLinkConn, _ := sessions.DownLink(edgenode_id); downLinkConn != nil {
+            selected = append(selected, edgenode_id)
+        }
+        return len(selected) < count
+    })
+
+    result := REBALANCE_RESULT{Requested: count, HandedBack: make([]string, 0)}
+    for _, edgenode_id := range selected {
+        err = sendCtrl2Edged(edgenode_id, TOPIC_RECONNECT, CTRL_RECONNECT)
+        if err != nil {
+            log.Println("handleRebalance failed for", edgenode_id, err)
+            continue
+        }
+        result.HandedBack = append(result.HandedBack, edgenode_id)
+    }
+
+    w.Header().Set("Content-Type","application/json")
+    json.NewEncoder(w).Encode(&result)
+}
+
+func sendCtrl2Edged(edgenode_id string, topic string, ctrl string) error {
+
+    downLinkConn, done := sessions.DownLink(edgenode_id)
+    if downLinkConn == nil {
+        return errors.New("this node not servered by me " + edgenode_id)
+    }
+
+    // the legacy edged knows the control message by the body
+    newMsg := newRequest(topic)
+    newMsg.Body = ctrl
+
+    reply, err := queues.Request(edgenode_id, done, newMsg, downLinkTimeout())
+    if err != nil {
+        return err
+    }
+
+    log.Println("Ctrl resp", edgenode_id, reply.ID, reply.Reply)
+    if reply.Type == MSG_ERROR {
+        return errors.New(reply.Error)
+    }
+    return nil
+}
+
+// DIRECTORY_EVENT is reported to the node directory in placement
+type DIRECTORY_EVENT struct {
+    EdgeNodeID     string `json:"edgenode_id"`
+    EdgeAccessHome string `json:"edgeaccess_home"`
+    Event          string `json:"event"` //attach or detach
+    Seq            uint64 `json:"seq"`
+}
+
+// directorySeq numbers the directory events of this EdgeAccess, so that
+// placement can order them without comparing the clocks of the hosts. It
+// starts from the startup time to keep increasing across restarts
+var directorySeq = uint64(time.Now().UnixNano())
+
+// DirectoryEntry tells which EdgeAccess the edge node is attached to
+type DirectoryEntry struct {
+    EdgeNodeID     string    `json:"edgenode_id"`
+    EdgeAccessHome string    `json:"edgeaccess_home"`
+    AttachedAt     time.Time `json:"attached_at"`
+}
+
+const (
+    DIRECTORY_ATTACH = "attach"
+    DIRECTORY_DETACH = "detach"
+
+    DIRECTORY_MISS_REDIRECT = "redirect"
+)
+
+// edgeaccess home should be regulated to scheme https://host:port
+func selfHome() string {
+    return "http://" + conf.Host + ":" + conf.Port
+}
+
+// reportDirectory reports the attach/detach event to placement in the
+// background, the sequence number is taken now so placement can order
+// the events
+func reportDirectory(edgenode_id string, event string) {
+    if conf.PlacementURL == "" {
+        return
+    }
+
+    e := DIRECTORY_EVENT{
+        EdgeNodeID:     edgenode_id,
+        EdgeAccessHome: selfHome(),
+        Event:          event,
+        Seq:            atomic.AddUint64(&directorySeq, 1),
+    }
+
+    go func() {
+        bytesBody, _ := json.Marshal(&e)
+        client := &http.Client{Timeout: 5 * time.Second}
+        req, err := http.NewRequest("POST", conf.PlacementURL+"/v1.0/directory",
+                                    bytes.NewBuffer(bytesBody))
+        if err != nil {
+            log.Println("report directory failed:", event, edgenode_id, err)
+            return
+        }
+        req.Header.Add("Content-Type", "application/json")
+        req.Header.Add("admin_token", conf.AdminToken)
+        resp, err := client.Do(req)
+        if err != nil {
+            log.Println("report directory failed:", event, edgenode_id, err)
+            return
+        }
+        resp.Body.Close()
+    }()
+}
+
+// lookupDirectory returns the home of the EdgeAccess the edge node is
+// attached to
+func lookupDirectory(edgenode_id string) (string, error) {
+    client := &http.Client{Timeout: 5 * time.Second}
+    resp, err := client.Get(conf.PlacementURL + "/v1.0/directory/" +
+                            url.PathEscape(edgenode_id))
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != 200 {
+        return "", errors.New("directory lookup " + resp.Status)
+    }
+
+    var entry DirectoryEntry
+    err = json.NewDecoder(resp.Body).Decode(&entry)
+    if err != nil {
+        return "", err
+    }
+    return entry.EdgeAccessHome, nil
+}
+
+// routeToOwner forwards or redirects the request to the EdgeAccess owning
+// the edge node. Return false if the owner is not found, the request is
+// forwarded already, or there is no node directory
+func routeToOwner(w http.ResponseWriter, r *http.Request, edgenode_id string) bool {
+    if conf.PlacementURL == "" || r.Header.Get("forwarded_by") != "" {
+        return false
+    }
+
+    owner, err := lookupDirectory(edgenode_id)
+    if err != nil {
+        log.Println("lookup directory failed:", edgenode_id, err)
+        return false
+    }
+    if owner == selfHome() {
+        return false
+    }
+
+    target := owner + r.URL.RequestURI()
+    if conf.DirectoryMiss == DIRECTORY_MISS_REDIRECT {
+        log.Println("redirect", edgenode_id, "to", owner)
+        http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+        return true
+    }
+
+    log.Println("forward", edgenode_id, "to", owner)
+    req, err := http.NewRequest(r.Method, target, r.Body)
+    if err != nil {
+        log.Println("forward failed:", err)
+        return false
+    }
+    req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+    req.Header.Set("forwarded_by", selfHome())
+
+    client := &http.Client{Timeout: forwardTimeout()}
+    resp, err := client.Do(req)
+    if err != nil {
+        http.Error(w, "forward to " + owner + " failed", http.StatusBadGateway)
+        return true
+    }
+    defer resp.Body.Close()
+
+    w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+    w.WriteHeader(resp.StatusCode)
+    io.Copy(w, resp.Body)
+    return true
+}
+
+// SAMPLE is one telemetry value of an edge node, the CPU utilization now
+type SAMPLE struct {
+    Time           int64   `json:"time"` //unix seconds
+    Value          float64 `json:"value"`
+}
+
+// BUCKET is the samples downsampled in [Time, Time+step)
+type BUCKET struct {
+    Time           int64   `json:"time"`
+    Count          int     `json:"count"`
+    Min            float64 `json:"min"`
+    Max            float64 `json:"max"`
+    Avg            float64 `json:"avg"`
+}
+
+type TELEMETRY_RESULT struct {
+    EdgeNodeID     string   `json:"edgenode_id"`
+    From           int64    `json:"from"`
+    To             int64    `json:"to"`
+    Step           int64    `json:"step,omitempty"`
+    Samples        []SAMPLE `json:"samples,omitempty"`
+    Buckets        []BUCKET `json:"buckets,omitempty"`
+
+    //the EdgeAccess the edge node moved to can't be reached, only the
+    //samples here are returned
+    Partial        bool     `json:"partial,omitempty"`
+}
+
+// sampleRing keeps the latest samples of one edge node
+type sampleRing struct {
+    items  []SAMPLE
+    head   int //the oldest sample once the ring is full
+}
+
+// add appends the sample, the oldest one is returned if it is evicted
+func (ring *sampleRing) add(sample SAMPLE, capacity int) (SAMPLE, bool) {
+    if len(ring.items) < capacity {
+        ring.items = append(ring.items, sample)
+        return SAMPLE{}, false
+    }
+    evicted := ring.items[ring.head]
+    ring.items[ring.head] = sample
+    ring.head = (ring.head + 1) % len(ring.items)
+    return evicted, true
+}
+
+// nodeTelemetry is the samples of one edge node, with its own lock so the
+// edge nodes don't wait for each other
+type nodeTelemetry struct {
+    lock   sync.Mutex
+    ring   sampleRing
+    spill  *spillWriter //nil until the first sample is spilled
+
+    //held to read the spill files, and to rotate them
+    files  sync.RWMutex
+}
+
+// spillWriter keeps the spill file open and buffered, it is flushed by
+// telemetryFlushLoop and before the file is read
+type spillWriter struct {
+    file   *os.File
+    buf    *bufio.Writer
+    size   int64
+    used   time.Time
+}
+
+// TelemetryStore keeps a bounded ring of samples for each edge node. The
+// samples evicted are appended to the spill file of the edge node if
+// telemetry_spill_dir is set, the file is rotated to ".old" once it
+// exceeds telemetry_spill_max_bytes. The store lock only guards the map,
+// each edge node has its own lock
+type TelemetryStore struct {
+    lock     sync.RWMutex
+    items    map[string]*nodeTelemetry //keyed by edge node id
+    capacity int
+    spillDir string
+    spillMax int64
+}
+
+func NewTelemetryStore(capacity int, spillDir string, spillMax int64) *TelemetryStore {
+    if capacity <= 0 {
+        capacity = 1024
+    }
+    if spillMax <= 0 {
+        spillMax = 10*1024*1024
+    }
+    return &TelemetryStore{
+        items:    make(map[string]*nodeTelemetry),
+        capacity: capacity,
+        spillDir: spillDir,
+        spillMax: spillMax,
+    }
+}
+
+// get returns the samples of the edge node, created if create is true
+func (t *TelemetryStore) get(edgenode_id string, create bool) *nodeTelemetry {
+    t.lock.RLock()
+    n := t.items[edgenode_id]
+    t.lock.RUnlock()
+    if n != nil || !create {
+        return n
+    }
+
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    n = t.items[edgenode_id]
+    if n == nil {
+        n = &nodeTelemetry{ring: sampleRing{items: make([]SAMPLE, 0, 16)}}
+        t.items[edgenode_id] = n
+    }
+    return n
+}
+
+func (t *TelemetryStore) Add(edgenode_id string, sample SAMPLE) {
+    n := t.get(edgenode_id, true)
+
+    n.lock.Lock()
+    defer n.lock.Unlock()
+
+    evicted, ok := n.ring.add(sample, t.capacity)
+    if ok && t.spillDir != "" {
+        err := t.spill(edgenode_id, n, evicted)
+        if err != nil {
+            log.Println("spill telemetry failed:", edgenode_id, err)
+        }
+    }
+}
+
+func (t *TelemetryStore) spillFile(edgenode_id string) string {
+    return filepath.Join(t.spillDir, url.PathEscape(edgenode_id) + ".jsonl")
+}
+
+// spill appends the sample to the buffered spill file, n.lock must be held
+func (t *TelemetryStore) spill(edgenode_id string, n *nodeTelemetry, sample SAMPLE) error {
+    path := t.spillFile(edgenode_id)
+    if n.spill != nil && n.spill.size >= t.spillMax {
+        n.files.Lock()
+        n.spill.close()
+        n.spill = nil
+        err := os.Rename(path, path + ".old")
+        n.files.Unlock()
+        if err != nil {
+            return err
+        }
+    }
+
+    if n.spill == nil {
+        f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+        if err != nil {
+            return err
+        }
+        var size int64
+        if fi, err := f.Stat(); err == nil {
+            size = fi.Size()
+        }
+        n.spill = &spillWriter{file: f, buf: bufio.NewWriter(f), size: size}
+    }
+
+    line, _ := json.Marshal(&sample)
+    written, err := n.spill.buf.Write(append(line, '\n'))
+    n.spill.size += int64(written)
+    n.spill.used  = time.Now()
+    return err
+}
+
+func (sw *spillWriter) close() {
+    sw.buf.Flush()
+    sw.file.Close()
+}
+
+// Flush writes the buffered samples to the spill files, and closes the
+// files not written within idle
+func (t *TelemetryStore) Flush(idle time.Duration) {
+    t.lock.RLock()
+    list := make([]*nodeTelemetry, 0, len(t.items))
+    for _, n := range t.items {
+        list = append(list, n)
+    }
+    t.lock.RUnlock()
+
+    now := time.Now()
+    for _, n := range list {
+        n.lock.Lock()
+        if n.spill != nil {
+            n.spill.buf.Flush()
+            if now.Sub(n.spill.used) > idle {
+                n.spill.close()
+                n.spill = nil
+            }
+        }
+        n.lock.Unlock()
+    }
+}
+
+func telemetryFlushLoop() {
+    for {
+        time.Sleep(time.Second)
+        telemetry.Flush(time.Minute)
+    }
+}
+
+// readSpill returns the samples in [from, to] of the spill files
+func (t *TelemetryStore) readSpill(edgenode_id string, from, to int64) []SAMPLE {
+    samples := make([]SAMPLE, 0)
+    path := t.spillFile(edgenode_id)
+    for _, p := range []string{path + ".old", path} {
+        f, err := os.Open(p)
+        if err != nil {
+            continue
+        }
+        scanner := bufio.NewScanner(f)
+        for scanner.Scan() {
+            var sample SAMPLE
+            if json.Unmarshal(scanner.Bytes(), &sample) != nil {
+                continue
+            }
+            if sample.Time >= from && sample.Time <= to {
+                samples = append(samples, sample)
+            }
+        }
+        f.Close()
+    }
+    return samples
+}
+
+// Query returns the samples in [from, to] sorted by the time, false if
+// nothing is known about the edge node. The spill files are read without
+// the lock of the edge node, only the rotation waits for the reading
+func (t *TelemetryStore) Query(edgenode_id string, from, to int64) ([]SAMPLE, bool) {
+    samples := make([]SAMPLE, 0)
+    n := t.get(edgenode_id, false)
+    if n != nil {
+        n.lock.Lock()
+        if n.spill != nil {
+            n.spill.buf.Flush()
+        }
+        for _, sample := range n.ring.items {
+            if sample.Time >= from && sample.Time <= to {
+                samples = append(samples, sample)
+            }
+        }
+        n.lock.Unlock()
+    }
+
+    if t.spillDir != "" {
+        if n != nil {
+            n.files.RLock()
+        }
+        samples = append(t.readSpill(edgenode_id, from, to), samples...)
+        if n != nil {
+            n.files.RUnlock()
+        }
+    }
+    if n == nil && len(samples) == 0 {
+        return samples, false
+    }
+
+    sort.SliceStable(samples, func(i, j int) bool {
+        return samples[i].Time < samples[j].Time
+    })
+    return samples, true
+}
+
+// downsample groups the sorted samples into the buckets of step seconds
+// from the time from, the empty buckets are skipped
+func downsample(samples []SAMPLE, from, step int64) []BUCKET {
+    buckets := make([]BUCKET, 0)
+    for _, sample := range samples {
+        start := from + (sample.Time - from) / step * step
+        n := len(buckets)
+        if n == 0 || buckets[n-1].Time != start {
+            buckets = append(buckets, BUCKET{Time: start, Min: sample.Value,
+                                             Max: sample.Value})
+            n++
+        }
+        b := &buckets[n-1]
+        if sample.Value < b.Min {
+            b.Min = sample.Value
+        }
+        if sample.Value > b.Max {
+            b.Max = sample.Value
+        }
+        b.Avg = (b.Avg*float64(b.Count) + sample.Value) / float64(b.Count+1)
+        b.Count++
+    }
+    return buckets
+}
+
+// recordSample stores the CPU utilization in the body of the message from
+// edged
+func recordSample(edgenode_id string, timestamp int64, body string) error {
+    value, err := strconv.ParseFloat(strings.TrimSpace(body), 64)
+    if err != nil {
+        return errNoCPU
+    }
+    addSample(edgenode_id, timestamp, value)
+    return nil
+}
+
+// addSample stores the CPU utilization of edged, the time of edged is used
+// if it is given
+func addSample(edgenode_id string, timestamp int64, value float64) {
+    if timestamp <= 0 {
+        timestamp = time.Now().Unix()
+    }
+    telemetry.Add(edgenode_id, SAMPLE{Time: timestamp, Value: value})
+}
+
+// queryTelemetry gets the raw samples of the edge node kept by the owner
+func queryTelemetry(owner string, edgenode_id string, from, to int64) ([]SAMPLE, error) {
+    req, err := http.NewRequest("GET", owner + "/v1.0/telemetry/" +
+                                url.PathEscape(edgenode_id) +
+                                "?from=" + strconv.FormatInt(from, 10) +
+                                "&to=" + strconv.FormatInt(to, 10), nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("forwarded_by", selfHome())
+
+    client := &http.Client{Timeout: downLinkTimeout()}
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, errors.New("telemetry query " + resp.Status)
+    }
+    var result TELEMETRY_RESULT
+    err = json.NewDecoder(resp.Body).Decode(&result)
+    if err != nil {
+        return nil, err
+    }
+    return result.Samples, nil
+}
+
+// handleTelemetry serves GET /v1.0/telemetry/{edgenode_id}?from=&to=&step=
+// from and to are unix seconds, the last hour by default. The samples are
+// downsampled to min/max/avg of each step seconds if step is given
+func handleTelemetry(w http.ResponseWriter, r *http.Request) {
+
+    edgenode_id := strings.TrimPrefix(r.URL.Path, "/v1.0/telemetry/")
+    if edgenode_id == "" || strings.Contains(edgenode_id, "/") {
+        http.Error(w, "invalid edge node id", 400)
+        return
+    }
+    if r.Method != "GET" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+
+    query := r.URL.Query()
+    now   := time.Now().Unix()
+    result := TELEMETRY_RESULT{EdgeNodeID: edgenode_id, From: now - 3600, To: now}
+    var err error
+    if v := query.Get("from"); v != "" {
+        result.From, err = strconv.ParseInt(v, 10, 64)
+    }
+    if v := query.Get("to"); v != "" && err == nil {
+        result.To, err = strconv.ParseInt(v, 10, 64)
+    }
+    if v := query.Get("step"); v != "" && err == nil {
+        result.Step, err = strconv.ParseInt(v, 10, 64)
+        if err == nil && result.Step <= 0 {
+            err = errors.New("step should be positive")
+        }
+    }
+    if err != nil || result.From > result.To {
+        http.Error(w, "invalid from, to or step", 400)
+        return
+    }
+
+    samples, found := telemetry.Query(edgenode_id, result.From, result.To)
+    if !found && routeToOwner(w, r, edgenode_id) {
+        return
+    }
+
+    // the edge node moved to another EdgeAccess, which has the rest of
+    // the history
+    if found && sessions.Get(edgenode_id) == nil &&
+        conf.PlacementURL != "" && r.Header.Get("forwarded_by") == "" {
+        owner, err := lookupDirectory(edgenode_id)
+        if err == nil && owner != selfHome() {
+            remote, err := queryTelemetry(owner, edgenode_id, result.From, result.To)
+            if err != nil {
+                log.Println("query telemetry of", edgenode_id, "from", owner, "failed:", err)
+                result.Partial = true
+            } else {
+                samples = append(samples, remote...)
+                sort.SliceStable(samples, func(i, j int) bool {
+                    return samples[i].Time < samples[j].Time
+                })
+            }
+        }
+    }
+
+    if result.Step > 0 {
+        result.Buckets = downsample(samples, result.From, result.Step)
+    } else {
+        result.Samples = samples
+    }
+
+    w.Header().Set("Content-Type","application/json")
+    json.NewEncoder(w).Encode(&result)
+}
+
+type EDGEACCESS_PING struct {
+    ConnNum        int    `json:"conn_num"`
+    MaxConn        int    `json:"max_conn"` //0 means no limit
+    Host           string `json:"host"`
+    Port           string `json:"port"`
+    ToEdged        string `json:"toedged_path"`
+    ToEdgeAccess   string `json:"toedgeaccess_path"`
+    BiAsync        string `json:"biasync_path"`
+
+    //topology labels: region, zone, rack, version
+    Labels         map[string]string `json:"labels"`
+}
+
+
+// body of the registration request, with the edge nodes attached so that
+// placement resyncs its node directory, as of the sequence number of the
+// directory events
+type EDGEACCESS_REGISTER struct {
+    EdgeAccessHome string          `json:"edgeaccess_home"`
+    PingResp       EDGEACCESS_PING `json:"ping_resp"`
+    Attached       []string        `json:"attached"`
+    Seq            uint64          `json:"seq"`
+}
+
+func newPingResp() EDGEACCESS_PING {
+    pingRsp := EDGEACCESS_PING{}
+    pingRsp.ConnNum       = sessions.Len()
+    pingRsp.MaxConn       = conf.MaxConn
     pingRsp.Host          = conf.Host
     pingRsp.Port          = conf.Port
     pingRsp.ToEdged       = conf.ToEdged
     pingRsp.ToEdgeAccess  = conf.ToEdgeAccess
     pingRsp.BiAsync       = conf.BiAsync
+    pingRsp.Labels        = conf.Labels
+    return pingRsp
+}
+
+// registerLoop registers this edgeaccess to placement, renews it
+// periodically, and deregisters it when being interrupted
+func registerLoop() {
+
+    interval := conf.RegisterInterval
+    if interval <= 0 {
+        interval = 5
+    }
+    ticker := time.NewTicker(time.Duration(interval)*time.Second)
+    defer ticker.Stop()
+
+    interrupt = make(chan os.Signal, 1)
+    signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+    err := register2Placement("POST")
+    if err != nil {
+        log.Println("register to placement failed:", err)
+    }
+
+    for {
+        select {
+        case <-ticker.C:
+            err = register2Placement("POST")
+            if err != nil {
+                log.Println("renew registration failed:", err)
+            }
+        case <-interrupt:
+            err = register2Placement("DELETE")
+            if err != nil {
+                log.Println("deregister from placement failed:", err)
+            }
+            os.Exit(0)
+        }
+    }
+}
+
+func register2Placement(method string) error {
+
+    reg := EDGEACCESS_REGISTER{}
+    reg.EdgeAccessHome = selfHome()
+    reg.PingResp       = newPingResp()
+
+    // the sequence number is taken before the list, so a later event is
+    // not undone by this one
+    reg.Seq            = atomic.LoadUint64(&directorySeq)
+    reg.Attached       = sessions.Select(&SELECTOR{})
+
+    bytesBody, err := json.Marshal(&reg)
+    if err != nil {
+        return err
+    }
+
+    // TODO: use https instead
+    client := &http.Client{Timeout: 5 * time.Second}
+    req, err := http.NewRequest(method,
+                                conf.PlacementURL+"/v1.0/edgeaccess/register",
+                                bytes.NewBuffer(bytesBody))
+    if err != nil {
+        return err
+    }
+    req.Header.Add("Content-Type", "application/json")
+    req.Header.Add("admin_token", conf.AdminToken)
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    log.Println("register2Placement", method, resp.Status)
+    if resp.StatusCode != http.StatusOK {
+        return errors.New("placement refused the registration: " + resp.Status)
+    }
+    return nil
+}
+
+func handlePing(w http.ResponseWriter, r *http.Request) {
+
+    log.Println("hanldePing...")
+
+    pingRsp := newPingResp()
 
     jsonBody, err := json.Marshal(&pingRsp)
     if err != nil{
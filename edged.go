@@ -4,14 +4,17 @@ import (
         "bytes"
         "crypto/tls"
         "encoding/json"
+        "errors"
         "flag"
         "log"
-        "math/rand"
+        "math"
         "net/http"
         "os"
         "os/exec"
+        "sort"
         "strconv"
         "strings"
+        "sync"
         "sync/atomic"
         "time"
         "github.com/gorilla/websocket"
@@ -27,22 +30,94 @@ type CONFIGURATION struct {
     PlacementURL string `json:"placementURL"`
     RetryPlacementInterval int `json:"retry_placement_interval"`
     RetryEdgeAccessInterval int `json:"retry_edgeaccess_interval"`
+
+    //seconds to wait when placement rejects the edge node, e.g. unknown
+    //or cordoned, 300 if not set
+    RetryRejectedInterval int `json:"retry_rejected_interval"`
+
+    //ask placement for the ranked candidates, and walk them before
+    //going back to placement
+    UseCandidates bool `json:"use_candidates"`
+
+    //location labels sent to placement, e.g. region and zone
+    Labels map[string]string `json:"labels"`
+
+    //seconds between the telemetry events on the BiAsync link, 10 if
+    //not set
+    TelemetryInterval int `json:"telemetry_interval"`
 }
 
 
+// MESSAGE is the envelope on the uplink and downlink. The message of
+// version 0 is the legacy one with only Body and Reply, its topic is
+// taken from the link it comes from
 type MESSAGE struct {
+    Version     int     `json:"version,omitempty"`
     ID          uint64  `json:"id"`
     TimeStamp   int64   `json:"timestamp"`
-    Body        string  `json:"body"` //just CPU utilization here
+
+    Type        string  `json:"type,omitempty"` //request, reply or error
+    Topic       string  `json:"topic,omitempty"`
+
+    //content type of the payload, application/json or text/plain
+    ContentType string          `json:"content_type,omitempty"`
+    Payload     json.RawMessage `json:"payload,omitempty"`
+
+    //of the reply, the http status code is used
+    Status      int     `json:"status,omitempty"`
+    Error       string  `json:"error,omitempty"`
+
+    Body        string  `json:"body"` //legacy text body, the CPU utilization
     Reply       string  `json:"reply"` //one filed to send back by the replier
 }
 
+const MESSAGE_VERSION = 1
+
+const (
+    MSG_REQUEST = "request"
+    MSG_REPLY   = "reply"
+    MSG_ERROR   = "error"
+)
+
+// topics of the messages, the legacy uplink message is telemetry, the
+// legacy downlink message is ping, or reconnect by the body
+const (
+    TOPIC_TELEMETRY    = "telemetry"
+    TOPIC_PING         = "ping"
+    TOPIC_COMMAND      = "command"
+    TOPIC_CONFIG       = "config"
+    TOPIC_RECONNECT    = "ctrl.reconnect"
+    TOPIC_NOTIFICATION = "notification"
+)
+
+// ASYNC_EVENT is the fire-and-forget event on the BiAsync link, in both
+// directions, handled by the topic
+type ASYNC_EVENT struct {
+    Topic       string  `json:"topic"`
+    TimeStamp   int64   `json:"timestamp"`
+    Body        string  `json:"body"`
+}
+
 type EDGEACCESS_URL struct {
     Host           string `json:"host"`
     Port           string `json:"port"`
     ToEdged        string `json:"toedged_path"`
     ToEdgeAccess   string `json:"toedgeaccess_path"`
     BiAsync        string `json:"biasync_path"`
+
+    //signed ticket from placement, sent to EdgeAccess on linking
+    Ticket         string `json:"ticket,omitempty"`
+}
+
+// one of the ranked EdgeAccess from placement, valid until LeaseExpire
+type EDGEACCESS_CANDIDATE struct {
+    EDGEACCESS_URL
+    Role           string `json:"role"` //primary or fallback
+    LeaseExpire    int64  `json:"lease_expire"`
+}
+
+type EDGEACCESS_CANDIDATES struct {
+    Candidates     []EDGEACCESS_CANDIDATE `json:"candidates"`
 }
 
 // global variables used in this file
@@ -58,6 +133,31 @@ var downLinkConn *websocket.Conn
 var biAsyncLinkConn *websocket.Conn
 var conf CONFIGURATION
 
+// events queued to send on the BiAsync link, and closed to stop the
+// writer of the link when the links are renewed
+var biAsyncCH chan ASYNC_EVENT
+var biAsyncDone chan struct{}
+
+// 1 while the BiAsync link is linked, the telemetry is sent on it then,
+// and on the uplink otherwise
+var biAsyncUp int32
+var placementTicket string
+
+// edgeaccess asks to reconnect via placement, e.g. for rebalance
+var reconnectCH chan string
+var reconnectReason string
+
+// the rest of the ranked candidates from placement
+var candidates []EDGEACCESS_CANDIDATE
+
+// control message asking edged to reconnect via placement
+const CTRL_RECONNECT = "ctrl:reconnect_via_placement"
+const RECONNECT_REBALANCE = "rebalance"
+
+// the BiAsync link is broken, the links are renewed like a failed uplink,
+// the candidates are still walked
+const RECONNECT_BIASYNC = "biasync"
+
 /* note: error and  exception are not carefully handled here */
 
 func main() {
@@ -83,6 +183,8 @@ func initConfAndVar(conf *CONFIGURATION) error {
 
     upLinkCH   =  make(chan MESSAGE)
     downLinkCH =  make(chan MESSAGE)
+    reconnectCH = make(chan string, 1)
+    biAsyncCH   = make(chan ASYNC_EVENT, BIASYNC_QUEUE)
 
     upLinkConn   = nil
     downLinkConn = nil
@@ -106,6 +208,10 @@ func initConfAndVar(conf *CONFIGURATION) error {
     log.Println("conf.placementURL", conf.PlacementURL)
     log.Println("conf.RetryPlacementInterval", conf.RetryPlacementInterval)
     log.Println("conf.RetryEdgeAccessInterval", conf.RetryEdgeAccessInterval)
+    log.Println("conf.RetryRejectedInterval", conf.RetryRejectedInterval)
+    log.Println("conf.UseCandidates", conf.UseCandidates)
+    log.Println("conf.Labels", conf.Labels)
+    log.Println("conf.TelemetryInterval", conf.TelemetryInterval)
 
     return nil
 }
@@ -127,8 +233,34 @@ func initLink() {
     ea.ToEdgeAccess = ""
     ea.BiAsync      = ""
 
+    // edgeaccess asks to reconnect via placement, so the rest of the
+    // candidates should not be used
+    if reconnectReason == RECONNECT_REBALANCE {
+        candidates = nil
+    }
+
     for {
 
+        if conf.UseCandidates {
+            // walk the candidates got from placement before going back
+            // to placement
+            tried, ok := walkCandidates()
+            if ok {
+                reconnectReason = ""
+                break
+            }
+            if tried {
+                time.Sleep(time.Duration(conf.RetryEdgeAccessInterval) * time.Second)
+            }
+
+            err := getEdgeAccessCandidates(conf.PlacementURL, &ea)
+            if err != nil {
+                log.Println("get EdgeAccess candidates from placement failed:", err)
+                sleepBeforeRetryPlacement(err)
+            }
+            continue
+        }
+
         // get EdgeAccess url from placement, the last edgeAccessURL is
         // passed so that the placement can make decision to change EdgeAccess
         // or not
@@ -138,7 +270,7 @@ func initLink() {
                              &ea)
         if err != nil {
             log.Println("get EdgeAccess URL from placement failed:", err)
-            time.Sleep(time.Duration(conf.RetryPlacementInterval) * time.Second)
+            sleepBeforeRetryPlacement(err)
             continue
         }
 
@@ -150,22 +282,69 @@ func initLink() {
         } else {
             // all links are established successfully
             log.Println("links to", ea.Host, ea.Port, "completed")
+            reconnectReason = ""
             break
         }
     }
 }
 
-func getEdgeAccess( crt, key, placementURL string, ea *EDGEACCESS_URL ) error {
+// back off with the hint from placement if there is
+func sleepBeforeRetryPlacement(err error) {
+    interval := time.Duration(conf.RetryPlacementInterval) * time.Second
+    if ra, ok := err.(*retryAfterError); ok {
+        interval = ra.after
+    }
+    time.Sleep(interval)
+}
+
+// walkCandidates tries to link to the candidates in order, the expired
+// and failed ones are dropped. Return whether any candidate is tried,
+// and whether the links are established
+func walkCandidates() (bool, bool) {
+    tried := false
+    for len(candidates) > 0 {
+        c := candidates[0]
+        candidates = candidates[1:]
+
+        if time.Now().Unix() >= c.LeaseExpire {
+            log.Println("candidate lease expired", c.Host, c.Port)
+            continue
+        }
+
+        tried = true
+        err := createLink(&c.EDGEACCESS_URL, conf.Crt, conf.Key)
+        if err != nil {
+            log.Println("create link to candidate failed", c.Role, c.Host, c.Port, err)
+            closeChannel()
+            continue
+        }
+
+        log.Println("links to", c.Role, c.Host, c.Port, "completed")
+        return tried, true
+    }
+    return tried, false
+}
+
+// retryAfterError is returned if placement asks edged to retry later
+type retryAfterError struct {
+    after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+    return "placement asks to retry after " + e.after.String()
+}
+
+// requestPlacement sends the last EdgeAccess to placement, and returns
+// the response if it's not asking to retry later
+func requestPlacement(dest string, ea *EDGEACCESS_URL) (*http.Response, error) {
 
     // edgeUUID and projectID should be stored in the cert.
     // cert, _ := tls.LoadX509KeyPair(crt, key)
 
-    // placementURL should be regulated to "https://host:port"
-    dest := placementURL + "/v1.0/edgeaccess"
     bytesBody, err := json.Marshal(ea)
     if err != nil {
         log.Println("Failed in handling getEdgeAccess body")
-        return err
+        return nil, err
     }
 
     // TODO: use https instead
@@ -173,26 +352,65 @@ func getEdgeAccess( crt, key, placementURL string, ea *EDGEACCESS_URL ) error {
     req, err := http.NewRequest("GET", dest, bytes.NewBuffer(bytesBody))
     if err != nil {
         log.Println("Failed in handling getEdgeAccess NewRequest")
-        return err
+        return nil, err
     }
     req.Header.Add("Accept", "application/json")
     req.Header.Add("project_id", conf.ProjectID)
     req.Header.Add("edgenode_id", conf.EdgeNodeID)
+    if reconnectReason != "" {
+        req.Header.Add("reconnect_reason", reconnectReason)
+    }
+    if len(conf.Labels) > 0 {
+        req.Header.Add("edgenode_labels", labelsHeader())
+    }
     resp, err := client.Do(req)
     if err != nil {
         log.Println("Failed in handling getEdgeAccess client.Do", err)
+        return nil, err
+    }
+
+    log.Println("response from placement code", dest, resp.Status)
+    if resp.StatusCode == http.StatusServiceUnavailable ||
+       resp.StatusCode == http.StatusTooManyRequests {
+        resp.Body.Close()
+        // all EdgeAccess are saturated, or the project reaches its quota,
+        // placement tells when to retry, but not sooner than configured
+        seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+        if err != nil || seconds < conf.RetryPlacementInterval {
+            seconds = conf.RetryPlacementInterval
+        }
+        return nil, &retryAfterError{time.Duration(seconds) * time.Second}
+    }
+    if resp.StatusCode == http.StatusForbidden {
+        resp.Body.Close()
+        // the edge node is not allowed, asking again soon doesn't help
+        seconds := conf.RetryRejectedInterval
+        if seconds <= 0 {
+            seconds = 300
+        }
+        log.Println("edge node rejected by placement, retry after", seconds, "seconds")
+        return nil, &retryAfterError{time.Duration(seconds) * time.Second}
+    }
+    return resp, nil
+}
+
+func getEdgeAccess( crt, key, placementURL string, ea *EDGEACCESS_URL ) error {
+
+    // placementURL should be regulated to "https://host:port"
+    dest := placementURL + "/v1.0/edgeaccess"
+    resp, err := requestPlacement(dest, ea)
+    if err != nil {
         return err
     }
     defer resp.Body.Close()
 
-    log.Println("response from placement code", dest, resp.Status)
     if resp.StatusCode != 200 {
         ea.Host         = ""
         ea.Port         = ""
         ea.ToEdged      = ""
         ea.ToEdgeAccess = ""
         ea.BiAsync      = ""
-        return nil
+        return errors.New("placement response " + resp.Status)
     }
 
     err = json.NewDecoder(resp.Body).Decode(&ea)
@@ -210,6 +428,40 @@ func getEdgeAccess( crt, key, placementURL string, ea *EDGEACCESS_URL ) error {
     return err
 }
 
+// getEdgeAccessCandidates gets the ranked candidates from placement, the
+// primary one comes first, then the fallbacks
+func getEdgeAccessCandidates(placementURL string, ea *EDGEACCESS_URL) error {
+
+    // placementURL should be regulated to "https://host:port"
+    dest := placementURL + "/v1.1/edgeaccess"
+    resp, err := requestPlacement(dest, ea)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != 200 {
+        return errors.New("placement response " + resp.Status)
+    }
+
+    var result EDGEACCESS_CANDIDATES
+    err = json.NewDecoder(resp.Body).Decode(&result)
+    if err != nil {
+        log.Println("Failed in handling NewDecoder response", err)
+        return err
+    }
+    if len(result.Candidates) == 0 {
+        return errors.New("no candidate from placement")
+    }
+
+    for _, c := range result.Candidates {
+        log.Println("Placement Resp, candidate", c.Role, c.Host, c.Port,
+                    "lease expire", time.Unix(c.LeaseExpire, 0))
+    }
+    candidates = result.Candidates
+    return nil
+}
+
 func createLink(ea *EDGEACCESS_URL, crt string, key string ) error {
 
     // cert, err := tls.LoadX509KeyPair(crt, key)
@@ -218,6 +470,9 @@ func createLink(ea *EDGEACCESS_URL, crt string, key string ) error {
     //     return err
     // }
 
+    // the ticket is sent on linking to each EdgeAccess
+    placementTicket = ea.Ticket
+
     // use wss instead
     cert := tls.Certificate{}
     err  := createUpLink("ws://"+ea.Host+":"+ea.Port+ea.ToEdgeAccess, cert)
@@ -230,16 +485,42 @@ func createLink(ea *EDGEACCESS_URL, crt string, key string ) error {
         log.Println("create DownLink failed, ", err)
         return err
     }
-    err = creaseBiAsyncLink("ws://"+ea.Host+":"+ea.Port+ea.BiAsync, cert)
-    if err != nil {
-        log.Println("create BiAsyncLink failed, ", err)
-        return err
+    // the BiAsync link is optional for EdgeAccess
+    if ea.BiAsync != "" {
+        err = creaseBiAsyncLink("ws://"+ea.Host+":"+ea.Port+ea.BiAsync, cert)
+        if err != nil {
+            log.Println("create BiAsyncLink failed, ", err)
+            return err
+        }
     }
 
     return nil
 }
 
 
+// labelsHeader joins the labels in "k1=v1,k2=v2"
+func labelsHeader() string {
+    labels := make([]string, 0, len(conf.Labels))
+    for k, v := range conf.Labels {
+        labels = append(labels, k+"="+v)
+    }
+    sort.Strings(labels)
+    return strings.Join(labels, ",")
+}
+
+// linkHeader identifies the edge node to EdgeAccess with the ticket
+func linkHeader() http.Header {
+    header := http.Header{"edgenode_id": {conf.EdgeNodeID},
+                          "project_id":  {conf.ProjectID}}
+    if len(conf.Labels) > 0 {
+        header["edgenode_labels"] = []string{labelsHeader()}
+    }
+    if placementTicket != "" {
+        header["placement_ticket"] = []string{placementTicket}
+    }
+    return header
+}
+
 func createUpLink(edgeAccessURL string, cert tls.Certificate) error {
 
     log.Println("create Up Link", edgeAccessURL)
@@ -252,7 +533,7 @@ func createUpLink(edgeAccessURL string, cert tls.Certificate) error {
     }
     var err error
     upLinkConn, _, err = dialer.Dial(edgeAccessURL,
-                                     http.Header{"edgenode_id": {conf.EdgeNodeID}})
+                                     linkHeader())
     if err != nil {
         log.Println("dial uplink failed:", edgeAccessURL, err)
         upLinkConn = nil
@@ -272,7 +553,7 @@ func createDownLink(edgeAccessURL string, cert tls.Certificate) error {
     }
     var err error
     downLinkConn, _, err = dialer.Dial(edgeAccessURL,
-                                       http.Header{"edgenode_id": {conf.EdgeNodeID}})
+                                       linkHeader())
     if err != nil {
         log.Println("dial downlink failed:", edgeAccessURL, err)
         downLinkConn = nil
@@ -283,14 +564,141 @@ func createDownLink(edgeAccessURL string, cert tls.Certificate) error {
 
 func creaseBiAsyncLink(edgeAccessURL string, cert tls.Certificate) error {
 
+    log.Println("create BiAsync Link", edgeAccessURL)
+
+    dialer := &websocket.Dialer{
+    //     TLSClientConfig: &tls.Config{
+    //         Certificates:       []tls.Certificate{cert},
+    //         InsecureSkipVerify: true,
+    //     },
+    }
+    conn, _, err := dialer.Dial(edgeAccessURL, linkHeader())
+    if err != nil {
+        log.Println("dial biasync link failed:", edgeAccessURL, err)
+        return err
+    }
+
+    biAsyncLinkConn = conn
+    biAsyncDone     = make(chan struct{})
+    atomic.StoreInt32(&biAsyncUp, 1)
+    go writeBiAsync(conn, biAsyncDone)
+    go readBiAsync(conn, biAsyncDone)
     return nil
 }
 
+// biAsyncBroken asks to renew the links when the BiAsync link fails, unless
+// it's closed by closeChannel already
+func biAsyncBroken(done chan struct{}) {
+    select {
+    case <-done:
+        return
+    default:
+    }
+
+    select {
+    case reconnectCH <- RECONNECT_BIASYNC:
+    default:
+        // a reconnect is pending already
+    }
+}
+
+// events queued on the BiAsync link before dropping
+const BIASYNC_QUEUE = 256
+
+// writeBiAsync sends the queued events on the BiAsync link until the
+// links are renewed, nothing is waited from EdgeAccess
+func writeBiAsync(conn *websocket.Conn, done chan struct{}) {
+    for {
+        select {
+        case e := <-biAsyncCH:
+            event, _ := json.Marshal(&e)
+            err := conn.WriteMessage(websocket.TextMessage, event)
+            if err != nil {
+                log.Println("biAsyncLink Write:", err, "drop event of", e.Topic)
+                biAsyncBroken(done)
+                return
+            }
+        case <-done:
+            return
+        }
+    }
+}
+
+// readBiAsync hands the events from EdgeAccess to the handler of the topic
+// as the messages of the downlink, nothing is replied
+func readBiAsync(conn *websocket.Conn, done chan struct{}) {
+    for {
+        _, msg, err := conn.ReadMessage()
+        if err != nil {
+            log.Println("biAsyncLink Read:", err)
+            biAsyncBroken(done)
+            return
+        }
+
+        var e ASYNC_EVENT
+        err = json.Unmarshal(msg, &e)
+        if err != nil {
+            log.Println("biAsyncLink decode err was", err)
+            continue
+        }
+
+        inMsg := MESSAGE{Version: MESSAGE_VERSION, Type: MSG_REQUEST,
+                         Topic: e.Topic, TimeStamp: e.TimeStamp, Body: e.Body}
+        reply := dispatchTopic(&inMsg)
+        if reply.Type == MSG_ERROR {
+            log.Println("biAsyncLink event dropped:", reply.Error, string(msg))
+        }
+    }
+}
+
+func handleNotificationMsg(in *MESSAGE) MESSAGE {
+    log.Println("notification from EdgeAccess:", in.Body)
+    return newReply(in)
+}
+
+// publishAsync queues the event to the BiAsync link without waiting, the
+// event is dropped if the queue is full
+func publishAsync(topic string, body string) error {
+    e := ASYNC_EVENT{Topic: topic, TimeStamp: time.Now().Unix(), Body: body}
+    select {
+    case biAsyncCH <- e:
+        return nil
+    default:
+        return errors.New("biasync queue full, drop event of " + topic)
+    }
+}
+
+// generateTelemetry publishes the CPU utilization on the BiAsync link,
+// it doesn't wait behind the synchronous uplink. The uplink is used only
+// if EdgeAccess has no BiAsync link, so each sample is sent once
+func generateTelemetry() {
+
+    for {
+        select {
+        case <-time.After(telemetryInterval()):
+        case <-configCH:
+            // the interval may be changed, wait the new one
+            continue
+        }
+
+        cpu := math.Round(getCPU()*100) / 100
+        if atomic.LoadInt32(&biAsyncUp) == 0 {
+            upLinkCH <- newTelemetryMsg(cpu)
+            continue
+        }
+
+        err := publishAsync(TOPIC_TELEMETRY, strconv.FormatFloat(cpu, 'f', 2, 64))
+        if err != nil {
+            log.Println("publish telemetry failed:", err)
+        }
+    }
+}
+
 
 func handleChannel() error {
 
-    go generateMsg()
     go consumerMsg()
+    go generateTelemetry()
 
     for {
         select {
@@ -301,6 +709,15 @@ func handleChannel() error {
                 // resume downLink message reading if connectionis renewed
                 go consumerMsg()
             }
+        case reason := <-reconnectCH:
+            if reason == RECONNECT_BIASYNC {
+                log.Println("biasync link broken, renew the links")
+            } else {
+                log.Println("reconnect via placement, reason:", reason)
+                reconnectReason = reason
+            }
+            renewConn()
+            go consumerMsg()
         }
     }
 }
@@ -326,7 +743,9 @@ func sendReq2EdgeAccess( outMsg *MESSAGE ) error {
     err = json.Unmarshal([]byte(resp), &respMsg)
 
     //need to check id in response, and especiall to handle the maximum value of int and it's reverse.
-    if respMsg.ID == outMsg.ID {
+    if respMsg.Type == MSG_ERROR {
+        log.Println("sendReq2EdgeAccess, error replied", respMsg.Status, respMsg.Error)
+    } else if respMsg.ID == outMsg.ID {
         log.Println("sendReq2EdgeAccess, replied", respMsg)
     } else {
         log.Println("sendReq2EdgeAccess, wrong order message", respMsg)
@@ -341,12 +760,145 @@ func renewConn() {
     initLink()
 }
 
+func newReply(in *MESSAGE) MESSAGE {
+    reply := *in
+    reply.Version   = MESSAGE_VERSION
+    reply.Type      = MSG_REPLY
+    reply.Status    = http.StatusOK
+    reply.ContentType = ""
+    reply.Payload   = nil
+    reply.Reply     = "touched by EdgeD at" + (time.Now()).Format("2006-01-02 15:04:05")
+    return reply
+}
+
+func newErrorReply(in *MESSAGE, status int, err error) MESSAGE {
+    reply := newReply(in)
+    reply.Type   = MSG_ERROR
+    reply.Status = status
+    reply.Error  = err.Error()
+    return reply
+}
+
+// handlers of the messages from EdgeAccess by the topic, both of the
+// downlink and of the BiAsync link. The reply is sent back on the
+// downlink, and only logged on error for the BiAsync link
+var topicHandlers = map[string]func(in *MESSAGE) MESSAGE{
+    TOPIC_PING:         handlePingMsg,
+    TOPIC_COMMAND:      handleCommandMsg,
+    TOPIC_CONFIG:       handleConfigMsg,
+    TOPIC_RECONNECT:    handlePingMsg,
+    TOPIC_NOTIFICATION: handleNotificationMsg,
+}
+
+// the configuration pushed by EdgeAccess on the config topic, it overrides
+// the one of the file, and configCH wakes up the telemetry on a change
+var pushedConfig = make(map[string]interface{})
+var pushedLock sync.Mutex
+var configCH = make(chan struct{}, 1)
+
+// telemetryInterval is the interval to publish the telemetry, the pushed
+// "telemetry_interval" in seconds is used if any
+func telemetryInterval() time.Duration {
+    pushedLock.Lock()
+    pushed, ok := pushedConfig["telemetry_interval"].(float64)
+    pushedLock.Unlock()
+    if ok {
+        return time.Duration(pushed*float64(time.Second))
+    }
+
+    interval := conf.TelemetryInterval
+    if interval <= 0 {
+        interval = 10
+    }
+    return time.Duration(interval)*time.Second
+}
+
+func downLinkTopic(in *MESSAGE) string {
+    if in.Topic != "" {
+        return in.Topic
+    }
+    if in.Body == CTRL_RECONNECT {
+        return TOPIC_RECONNECT
+    }
+    return TOPIC_PING
+}
+
+// dispatchTopic hands the message to the handler of its topic
+func dispatchTopic(in *MESSAGE) MESSAGE {
+    if in.Version > MESSAGE_VERSION {
+        return newErrorReply(in, http.StatusBadRequest,
+                             errors.New("unsupported message version"))
+    }
+
+    topic := downLinkTopic(in)
+    handler := topicHandlers[topic]
+    if handler == nil {
+        return newErrorReply(in, http.StatusNotFound,
+                             errors.New("no handler for topic " + topic))
+    }
+    return handler(in)
+}
+
+func handlePingMsg(in *MESSAGE) MESSAGE {
+    return newReply(in)
+}
+
+func handleCommandMsg(in *MESSAGE) MESSAGE {
+    log.Println("command from EdgeAccess:", in.ID, in.Body, string(in.Payload))
+    return newReply(in)
+}
+
+// handleConfigMsg applies the json object of the payload to the pushed
+// configuration, and replies the configuration applied
+func handleConfigMsg(in *MESSAGE) MESSAGE {
+    var values map[string]interface{}
+    err := json.Unmarshal(in.Payload, &values)
+    if err != nil {
+        return newErrorReply(in, http.StatusBadRequest, err)
+    }
+    if v, ok := values["telemetry_interval"]; ok {
+        interval, ok := v.(float64)
+        if !ok || interval < 1 {
+            return newErrorReply(in, http.StatusBadRequest,
+                                 errors.New("telemetry_interval must be a number of seconds, at least 1"))
+        }
+    }
+
+    pushedLock.Lock()
+    for k, v := range values {
+        pushedConfig[k] = v
+    }
+    applied, _ := json.Marshal(pushedConfig)
+    pushedLock.Unlock()
+    log.Println("config pushed by EdgeAccess:", string(applied))
+
+    select {
+    case configCH <- struct{}{}:
+    default:
+    }
+
+    reply := newReply(in)
+    reply.ContentType = "application/json"
+    reply.Payload     = applied
+    return reply
+}
+
 func processDownLinkMsg( inMsg *MESSAGE) error {
 
     //process downLink request synchrounously
-    inMsg.Reply = "touched by EdgeD at" + (time.Now()).Format("2006-01-02 15:04:05")
+    reply := dispatchTopic(inMsg)
 
-    return reply2EdgeAccess(inMsg)
+    err := reply2EdgeAccess(&reply)
+    if err != nil {
+        return err
+    }
+
+    // stop reading the downLink, the links will be renewed
+    if downLinkTopic(inMsg) == TOPIC_RECONNECT {
+        reconnectCH <- RECONNECT_REBALANCE
+        return errors.New("reconnect via placement")
+    }
+    return nil
 }
 
 func reply2EdgeAccess( inMsg *MESSAGE) error {
@@ -373,6 +925,8 @@ func closeChannel() error {
     }
 
     if biAsyncLinkConn != nil {
+        atomic.StoreInt32(&biAsyncUp, 0)
+        close(biAsyncDone)
         biAsyncLinkConn.Close()
         biAsyncLinkConn = nil
     }
@@ -386,21 +940,19 @@ func newID() uint64 {
     return globalCounter
 }
 
-func generateMsg( ) {
-
-    for {
-        rand.Seed(time.Now().Unix())
-        //time.Sleep(time.Duration(rand.Intn(10))*time.Second)
-        time.Sleep(30*time.Second)
-
-        var newMsg MESSAGE
-        newMsg.ID        = newID()
-        newMsg.Body      = strconv.FormatFloat(getCPU(), 'f', 2, 64)
-        newMsg.TimeStamp = time.Now().Unix()
-        newMsg.Reply     = "" //will be touched by the receiver
-
-        upLinkCH <- newMsg
-    }
+// newTelemetryMsg is the telemetry message on the uplink
+func newTelemetryMsg(cpu float64) MESSAGE {
+    var newMsg MESSAGE
+    newMsg.Version     = MESSAGE_VERSION
+    newMsg.ID          = newID()
+    newMsg.Type        = MSG_REQUEST
+    newMsg.Topic       = TOPIC_TELEMETRY
+    newMsg.ContentType = "application/json"
+    newMsg.Payload, _  = json.Marshal(map[string]float64{"cpu": cpu})
+    newMsg.Body        = strconv.FormatFloat(cpu, 'f', 2, 64) //for the legacy EdgeAccess
+    newMsg.TimeStamp   = time.Now().Unix()
+    newMsg.Reply       = "" //will be touched by the receiver
+    return newMsg
 }
 
 
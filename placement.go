@@ -1,14 +1,27 @@
 package main
 
 import (
+        "crypto/hmac"
+        "crypto/sha256"
+        "encoding/base64"
         "encoding/json"
         "errors"
         "flag"
+        "fmt"
+        "hash/fnv"
+        "io"
         "io/ioutil"
         "log"
+        "math"
+        "math/rand"
         "net/http"
         "os"
+        "os/signal"
         "sort"
+        "strconv"
+        "strings"
+        "sync"
+        "syscall"
         "time"
 )
 
@@ -19,269 +32,3034 @@ type EDGEACCESS_URL struct {
     ToEdged        string `json:"toedged_path"`
     ToEdgeAccess   string `json:"toedgeaccess_path"`
     BiAsync        string `json:"biasync_path"`
+
+    //signed ticket for the edge node to link to this EdgeAccess
+    Ticket         string `json:"ticket,omitempty"`
+}
+
+// PLACEMENT_TICKET is signed by placement, and verified by EdgeAccess
+// before it accepts the links of the edge node
+type PLACEMENT_TICKET struct {
+    EdgeNodeID     string `json:"edgenode_id"`
+    ProjectID      string `json:"project_id"`
+    EdgeAccess     string `json:"edgeaccess"` //host:port of the target
+    Expire         int64  `json:"expire"`
+}
+
+
+// one of the ranked EdgeAccess returned by /v1.1/edgeaccess, valid until
+// LeaseExpire in unix time
+type EDGEACCESS_CANDIDATE struct {
+    EDGEACCESS_URL
+    Role           string `json:"role"`
+    LeaseExpire    int64  `json:"lease_expire"`
+}
+
+type EDGEACCESS_CANDIDATES struct {
+    Candidates     []EDGEACCESS_CANDIDATE `json:"candidates"`
+}
+
+const (
+    CANDIDATE_PRIMARY  = "primary"
+    CANDIDATE_FALLBACK = "fallback"
+)
+
+
+type EDGEACCESS_PING struct {
+    ConnNum        int    `json:"conn_num"`
+    MaxConn        int    `json:"max_conn"` //0 means no limit
+    Host           string `json:"host"`
+    Port           string `json:"port"`
+    ToEdged        string `json:"toedged_path"`
+    ToEdgeAccess   string `json:"toedgeaccess_path"`
+    BiAsync        string `json:"biasync_path"`
+
+    //topology labels: region, zone, rack, version
+    Labels         map[string]string `json:"labels"`
+}
+
+const (
+    LABEL_REGION  = "region"
+    LABEL_ZONE    = "zone"
+)
+
+type EdgeAccess struct {
+    LastResponse   time.Time `json:"last_response"`
+    EdgeAccessHome string    `json:"edgeaccess_home"`
+    PingResp       EDGEACCESS_PING `json:"ping_resp"`
+
+    //static one comes from edgeaccess_homes, and never expires,
+    //others are registered by the edgeaccess itself
+    Static         bool      `json:"static"`
+    LastRegister   time.Time `json:"last_register"`
+
+    //cordoned one is kept alive but never selected for new edge nodes
+    Cordoned       bool      `json:"cordoned"`
+
+    //edge nodes sent to it since the last ping response, the ConnNum
+    //reported doesn't count them yet
+    Pending        int       `json:"pending"`
+
+    //the last time it's asked to hand back sessions, the ConnNum reported
+    //before that still counts them
+    DrainedAt      time.Time `json:"drained_at"`
+
+    //health state maintained by the probes, see HealthPolicy
+    Healthy        bool          `json:"healthy"`
+    Failures       int           `json:"consecutive_failures"`
+    Successes      int           `json:"consecutive_successes"`
+    LastLatency    time.Duration `json:"last_latency"`
+    AvgLatency     time.Duration `json:"avg_latency"` //moving average
+    Ejected        bool          `json:"ejected"`
+    EjectedUntil   time.Time     `json:"ejected_until"`
+    EjectCount     int           `json:"eject_count"`
+    probing        bool
+}
+
+// HealthPolicy decides how the probe results change the health state
+type HealthPolicy struct {
+    //consecutive failures to mark an edgeaccess down, and consecutive
+    //successes to mark it up again
+    FailThreshold     int
+    SuccessThreshold  int
+
+    //an edgeaccess is ejected as an outlier if its average latency is
+    //over OutlierFactor times of the median, and over OutlierMinLatency.
+    //0 OutlierFactor disables the outlier detection
+    OutlierFactor     float64
+    OutlierMinLatency time.Duration
+    EjectDuration     time.Duration
+    MaxEjectPercent   int
+}
+
+// body of the registration request sent by edgeaccess, with the edge
+// nodes attached to it to resync the node directory, as of the sequence
+// number of its directory events
+type EDGEACCESS_REGISTER struct {
+    EdgeAccessHome string          `json:"edgeaccess_home"`
+    PingResp       EDGEACCESS_PING `json:"ping_resp"`
+    Attached       []string        `json:"attached"`
+    Seq            uint64          `json:"seq"`
+}
+type EdgeAccesses []EdgeAccess
+func (p EdgeAccesses) Len() int { return len(p) }
+func (p EdgeAccesses) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p EdgeAccesses) Less(i, j int) bool {
+    return p[i].Load() < p[j].Load()
+}
+
+// Load is the connection number reported, plus the edge nodes sent to it
+// after that
+func (v *EdgeAccess) Load() int {
+    return v.PingResp.ConnNum + v.Pending
+}
+
+// EdgeAccessRegistry owns the EdgeAccess records, the health check
+// goroutines update the records through it, and the http handlers only
+// work on the snapshot copied out of it, so that no one sees a half
+// updated or re-sorted list
+type EdgeAccessRegistry struct {
+    lock    sync.RWMutex
+    homes   []string               //keep the order of registration
+    items   map[string]*EdgeAccess //keyed by edgeaccess home url
+    policy  HealthPolicy
+
+    //cordoned homes, kept when the edgeaccess expires or placement
+    //restarts, and persisted to cordonPath
+    cordons    map[string]bool
+    cordonPath string
+}
+
+func NewEdgeAccessRegistry(policy HealthPolicy) *EdgeAccessRegistry {
+    return &EdgeAccessRegistry{
+        homes:   make([]string, 0),
+        items:   make(map[string]*EdgeAccess),
+        policy:  policy,
+        cordons: make(map[string]bool),
+    }
+}
+
+// LoadCordons reads the cordoned homes from the local file, and applies
+// them to the edgeaccess known already. A missing file is not an error
+func (r *EdgeAccessRegistry) LoadCordons(path string) error {
+    homes := make([]string, 0)
+    err := loadJSONFile(path, &homes)
+    if err != nil {
+        return err
+    }
+
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    r.cordonPath = path
+    for _, home := range homes {
+        r.cordons[home] = true
+        if ea, ok := r.items[home]; ok {
+            ea.Cordoned = true
+        }
+    }
+    return nil
+}
+
+// Add registers a new edgeaccess home, it's a no-op if it exists already
+func (r *EdgeAccessRegistry) Add(home string, static bool) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    r.add(home, static)
+}
+
+func (r *EdgeAccessRegistry) add(home string, static bool) *EdgeAccess {
+    if ea, ok := r.items[home]; ok {
+        return ea
+    }
+
+    var ea EdgeAccess
+    ea.LastResponse           = time.Now()
+    ea.EdgeAccessHome         = home
+    ea.PingResp.ConnNum       = 0
+    ea.PingResp.Host          = ""
+    ea.PingResp.Port          = ""
+    ea.PingResp.ToEdged       = ""
+    ea.PingResp.ToEdgeAccess  = ""
+    ea.PingResp.BiAsync       = ""
+    ea.Static                 = static
+    ea.LastRegister           = ea.LastResponse
+    ea.Cordoned               = r.cordons[home]
+
+    r.homes = append(r.homes, home)
+    r.items[home] = &ea
+    return &ea
+}
+
+// Register adds or renews an edgeaccess registered by itself, the ping
+// data in the registration is taken as a fresh ping response. Return true
+// if it's a new one
+func (r *EdgeAccessRegistry) Register(home string, resp *EDGEACCESS_PING) bool {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    _, exist := r.items[home]
+    ea := r.add(home, false)
+
+    ea.LastResponse = time.Now()
+    ea.LastRegister = ea.LastResponse
+    ea.PingResp     = *resp
+    ea.Pending      = 0
+
+    // the registration itself shows it's working
+    if !exist {
+        ea.Healthy = true
+    }
+    return !exist
+}
+
+// Reconcile makes the static edgeaccess match the homes, the new ones are
+// added, the static ones not in homes are removed, and the others are kept
+// as they are. A registered one listed in homes becomes static
+func (r *EdgeAccessRegistry) Reconcile(homes []string) ([]string, []string) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    listed  := make(map[string]bool)
+    added   := make([]string, 0)
+    removed := make([]string, 0)
+    for _, home := range homes {
+        listed[home] = true
+        if ea, ok := r.items[home]; ok {
+            ea.Static = true
+            continue
+        }
+        r.add(home, true)
+        added = append(added, home)
+    }
+
+    kept := make([]string, 0, len(r.homes))
+    for _, home := range r.homes {
+        if r.items[home].Static && !listed[home] {
+            delete(r.items, home)
+            removed = append(removed, home)
+            continue
+        }
+        kept = append(kept, home)
+    }
+    r.homes = kept
+    return added, removed
+}
+
+// Get returns a copy of the edgeaccess
+func (r *EdgeAccessRegistry) Get(home string) (EdgeAccess, bool) {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+
+    ea, ok := r.items[home]
+    if !ok {
+        return EdgeAccess{}, false
+    }
+    return *ea, true
+}
+
+// AddPending counts an edge node sent to the edgeaccess, until the next
+// ping response reports it
+func (r *EdgeAccessRegistry) AddPending(home string) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    if ea, ok := r.items[home]; ok {
+        ea.Pending++
+    }
+}
+
+// MarkDrained records the edgeaccess is asked to hand back sessions, it's
+// not asked again until a ping response after that
+func (r *EdgeAccessRegistry) MarkDrained(home string) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    if ea, ok := r.items[home]; ok {
+        ea.DrainedAt = time.Now()
+    }
+}
+
+// SetCordon cordons or uncordons the edgeaccess, and persists the
+// cordoned homes. Return false if the edgeaccess is not found
+func (r *EdgeAccessRegistry) SetCordon(home string, cordoned bool) (bool, error) {
+    r.lock.Lock()
+    ea, ok := r.items[home]
+    if !ok {
+        r.lock.Unlock()
+        return false, nil
+    }
+    ea.Cordoned = cordoned
+    if cordoned {
+        r.cordons[home] = true
+    } else {
+        delete(r.cordons, home)
+    }
+
+    homes := make([]string, 0, len(r.cordons))
+    for h := range r.cordons {
+        homes = append(homes, h)
+    }
+    path := r.cordonPath
+    r.lock.Unlock()
+
+    sort.Strings(homes)
+    return true, saveJSONFile(path, homes)
+}
+
+// Remove deletes an edgeaccess from the registry, return false if not found
+func (r *EdgeAccessRegistry) Remove(home string) bool {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    if _, ok := r.items[home]; !ok {
+        return false
+    }
+
+    delete(r.items, home)
+    for i, v := range r.homes {
+        if v == home {
+            r.homes = append(r.homes[:i], r.homes[i+1:]...)
+            break
+        }
+    }
+    return true
+}
+
+// Expire removes the registered edgeaccess which has not renewed the
+// registration within ttl, the static ones are kept anyway
+func (r *EdgeAccessRegistry) Expire(ttl time.Duration) []string {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    now     := time.Now()
+    homes   := make([]string, 0, len(r.homes))
+    expired := make([]string, 0)
+    for _, home := range r.homes {
+        ea := r.items[home]
+        if !ea.Static && now.Sub(ea.LastRegister) > ttl {
+            delete(r.items, home)
+            expired = append(expired, home)
+            continue
+        }
+        homes = append(homes, home)
+    }
+    r.homes = homes
+    return expired
+}
+
+// Homes returns a copy of all registered edgeaccess home url
+func (r *EdgeAccessRegistry) Homes() []string {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+
+    homes := make([]string, len(r.homes))
+    copy(homes, r.homes)
+    return homes
+}
+
+// BeginProbe marks a probe of the edgeaccess in flight, return false if
+// the last one is not finished yet, so a hung edgeaccess never piles up
+// the probe goroutines
+func (r *EdgeAccessRegistry) BeginProbe(home string) bool {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    ea, ok := r.items[home]
+    if !ok || ea.probing {
+        return false
+    }
+    ea.probing = true
+    return true
+}
+
+// UpdatePing records the ping response of one edgeaccess, the record is
+// looked up by home url, so the update always lands on the right one.
+// Return whether it's found, and whether it turns to healthy by this ping
+func (r *EdgeAccessRegistry) UpdatePing(home string, resp *EDGEACCESS_PING, latency time.Duration) (bool, bool) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    ea, ok := r.items[home]
+    if !ok {
+        return false, false
+    }
+
+    ea.probing      = false
+    ea.LastResponse = time.Now()
+    ea.PingResp     = *resp
+    ea.Pending      = 0
+    ea.LastLatency  = latency
+    if ea.AvgLatency == 0 {
+        ea.AvgLatency = latency
+    } else {
+        ea.AvgLatency = (ea.AvgLatency*7 + latency*3) / 10
+    }
+
+    ea.Failures = 0
+    ea.Successes++
+    if !ea.Healthy && ea.Successes >= r.policy.SuccessThreshold {
+        ea.Healthy = true
+        return true, true
+    }
+    return true, false
+}
+
+// ProbeFailed records a failed probe, return true if the edgeaccess
+// turns to unhealthy by this failure
+func (r *EdgeAccessRegistry) ProbeFailed(home string) bool {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    ea, ok := r.items[home]
+    if !ok {
+        return false
+    }
+
+    ea.probing   = false
+    ea.Successes = 0
+    ea.Failures++
+    if ea.Healthy && ea.Failures >= r.policy.FailThreshold {
+        ea.Healthy = false
+        return true
+    }
+    return false
+}
+
+// DetectOutliers ejects the healthy edgeaccess much slower than the
+// others, and recovers the ejected ones whose ejection expires and the
+// latency of the recovery probes is back to normal
+func (r *EdgeAccessRegistry) DetectOutliers() ([]string, []string) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    ejected   := make([]string, 0)
+    recovered := make([]string, 0)
+    if r.policy.OutlierFactor <= 0 {
+        return ejected, recovered
+    }
+
+    now       := time.Now()
+    latencies := make([]time.Duration, 0, len(r.homes))
+    numEjected := 0
+    for _, home := range r.homes {
+        ea := r.items[home]
+        if ea.Ejected {
+            numEjected++
+        } else if ea.Healthy && ea.AvgLatency > 0 {
+            latencies = append(latencies, ea.AvgLatency)
+        }
+    }
+
+    // the ejected ones are checked for recovery even if there is no peer
+    // to compare with, they are not outliers without the others
+    threshold := time.Duration(math.MaxInt64)
+    if len(latencies) > 0 {
+        sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+        median   := latencies[len(latencies)/2]
+        threshold = time.Duration(float64(median) * r.policy.OutlierFactor)
+        if threshold < r.policy.OutlierMinLatency {
+            threshold = r.policy.OutlierMinLatency
+        }
+    }
+
+    // the recovered ones are not ejected again in the same round
+    checked := make(map[string]bool)
+    for _, home := range r.homes {
+        ea := r.items[home]
+        if !ea.Ejected || now.Before(ea.EjectedUntil) {
+            continue
+        }
+        checked[home] = true
+        if ea.Healthy && ea.LastLatency <= threshold {
+            ea.Ejected    = false
+            ea.EjectCount = 0
+            recovered = append(recovered, home)
+        } else {
+            ea.EjectCount++
+            ea.EjectedUntil = now.Add(r.ejectDuration(ea.EjectCount))
+        }
+    }
+
+    // the median of less than 2 doesn't tell an outlier
+    if len(latencies) < 2 {
+        return ejected, recovered
+    }
+
+    // never eject too many of them, the healthy ones are still better
+    // than nothing
+    budget := (len(latencies) + numEjected) * r.policy.MaxEjectPercent / 100 - numEjected
+    for _, home := range r.homes {
+        ea := r.items[home]
+        if ea.Ejected || checked[home] {
+            continue
+        }
+
+        if budget > 0 && ea.Healthy && ea.AvgLatency > threshold {
+            budget--
+            ea.Ejected = true
+            ea.EjectCount++
+            ea.EjectedUntil = now.Add(r.ejectDuration(ea.EjectCount))
+            ejected = append(ejected, home)
+        }
+    }
+    return ejected, recovered
+}
+
+// ejectDuration backs off for the repeatedly ejected one, at most 8 times
+func (r *EdgeAccessRegistry) ejectDuration(count int) time.Duration {
+    if count > 8 {
+        count = 8
+    }
+    return r.policy.EjectDuration * time.Duration(count)
+}
+
+// Snapshot returns a copy of all the records, sorted by the connection
+// number, the least loaded one comes first
+func (r *EdgeAccessRegistry) Snapshot() EdgeAccesses {
+    r.lock.RLock()
+    list := make(EdgeAccesses, 0, len(r.homes))
+    for _, home := range r.homes {
+        list = append(list, *r.items[home])
+    }
+    r.lock.RUnlock()
+
+    sort.Stable(list)
+    return list
+}
+
+var listEdgeAccess *EdgeAccessRegistry
+
+
+// Assignment records which EdgeAccess an edge node is sent to
+type Assignment struct {
+    EdgeNodeID     string         `json:"edgenode_id"`
+    ProjectID      string         `json:"project_id"`
+    EdgeAccess     EDGEACCESS_URL `json:"edgeaccess"`
+    AssignedAt     time.Time      `json:"assigned_at"`
+    LastSeen       time.Time      `json:"last_seen"`
+}
+
+// AssignmentTable keeps the assignment of each edge node, and persists
+// it to a local file so that it survives a restart. The changes are only
+// marked dirty on the request path, and written by Flush in the background
+type AssignmentTable struct {
+    lock   sync.RWMutex
+    path   string
+    items  map[string]*Assignment //keyed by edge node id
+    dirty  bool
+}
+
+func NewAssignmentTable(path string) *AssignmentTable {
+    return &AssignmentTable{
+        path:  path,
+        items: make(map[string]*Assignment),
+    }
+}
+
+// Load reads the table from the local file, a missing file is not an error
+func (t *AssignmentTable) Load() error {
+    items := make(map[string]*Assignment)
+    err := loadJSONFile(t.path, &items)
+    if err != nil {
+        return err
+    }
+
+    t.lock.Lock()
+    t.items = items
+    t.lock.Unlock()
+    return nil
+}
+
+// Flush writes the table to the local file if it's changed, the file is
+// written from a copy without holding the lock
+func (t *AssignmentTable) Flush() error {
+    t.lock.Lock()
+    if !t.dirty {
+        t.lock.Unlock()
+        return nil
+    }
+    items := make(map[string]Assignment, len(t.items))
+    for id, a := range t.items {
+        items[id] = *a
+    }
+    t.dirty = false
+    t.lock.Unlock()
+
+    err := saveJSONFile(t.path, items)
+    if err != nil {
+        // try again on the next flush
+        t.lock.Lock()
+        t.dirty = true
+        t.lock.Unlock()
+    }
+    return err
+}
+
+// Expire removes the assignments not seen within ttl, except the edge
+// nodes still attached, which don't ask placement again while linked.
+// Return the edge nodes removed
+func (t *AssignmentTable) Expire(ttl time.Duration, attached func(string) bool) []string {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    expired := make([]string, 0)
+    now     := time.Now()
+    for id, a := range t.items {
+        if now.Sub(a.LastSeen) <= ttl {
+            continue
+        }
+        if attached(id) {
+            a.LastSeen = now
+            t.dirty = true
+            continue
+        }
+        delete(t.items, id)
+        t.dirty = true
+        expired = append(expired, id)
+    }
+    return expired
+}
+
+// saveJSONFile replaces the file atomically, so a crash never leaves
+// a broken one, nothing is saved if path is empty
+func saveJSONFile(path string, v interface{}) error {
+    if path == "" {
+        return nil
+    }
+
+    data, err := json.MarshalIndent(v, "", "    ")
+    if err != nil {
+        return err
+    }
+
+    tmp := path + ".tmp"
+    err = ioutil.WriteFile(tmp, data, 0644)
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+// loadJSONFile reads the file into v, a missing file is not an error
+func loadJSONFile(path string, v interface{}) error {
+    if path == "" {
+        return nil
+    }
+
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+// Get returns a copy of the assignment of the edge node
+func (t *AssignmentTable) Get(edgeUUID string) (Assignment, bool) {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+
+    a, ok := t.items[edgeUUID]
+    if !ok {
+        return Assignment{}, false
+    }
+    return *a, true
+}
+
+// List returns a copy of all the assignments
+func (t *AssignmentTable) List() []Assignment {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+
+    list := make([]Assignment, 0, len(t.items))
+    for _, a := range t.items {
+        list = append(list, *a)
+    }
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].EdgeNodeID < list[j].EdgeNodeID
+    })
+    return list
+}
+
+// Set records the EdgeAccess assigned to the edge node, the assigned
+// time is kept if it's the same EdgeAccess as before. Return true if
+// the edge node is assigned to a different EdgeAccess. A new edge node of
+// the project is rejected with errOverQuota if quota live ones are there,
+// the check and the insert are done under the same lock
+func (t *AssignmentTable) Set(edgeUUID string, projectUUID string, ea *EDGEACCESS_URL,
+                              quota int, live func(*Assignment) bool) (bool, error) {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    if quota > 0 && t.countProject(projectUUID, edgeUUID, live) >= quota {
+        return false, errOverQuota
+    }
+
+    now     := time.Now()
+    changed := false
+    a, ok   := t.items[edgeUUID]
+    if !ok || a.EdgeAccess.Host != ea.Host || a.EdgeAccess.Port != ea.Port {
+        a = &Assignment{EdgeNodeID: edgeUUID, AssignedAt: now}
+        t.items[edgeUUID] = a
+        changed = true
+    }
+    a.ProjectID  = projectUUID
+    a.EdgeAccess = *ea
+    a.LastSeen   = now
+    t.dirty      = true
+
+    return changed, nil
+}
+
+// Attach records the EdgeAccess the edge node actually attached to, which
+// may be a fallback instead of the one assigned. Only the edge node
+// assigned already is updated. Return true if the EdgeAccess is changed
+func (t *AssignmentTable) Attach(edgeUUID string, ea *EDGEACCESS_URL) (Assignment, bool) {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    a, ok := t.items[edgeUUID]
+    if !ok {
+        return Assignment{}, false
+    }
+
+    now     := time.Now()
+    changed := a.EdgeAccess.Host != ea.Host || a.EdgeAccess.Port != ea.Port
+    if changed {
+        a.AssignedAt = now
+        a.EdgeAccess = *ea
+    }
+    a.LastSeen = now
+    t.dirty    = true
+    return *a, changed
+}
+
+// CountProject returns the number of live edge nodes assigned in the
+// project, except the given one
+func (t *AssignmentTable) CountProject(projectUUID string, except string,
+                                       live func(*Assignment) bool) int {
+    t.lock.RLock()
+    defer t.lock.RUnlock()
+
+    return t.countProject(projectUUID, except, live)
+}
+
+// countProject should be called with the lock held
+func (t *AssignmentTable) countProject(projectUUID string, except string,
+                                       live func(*Assignment) bool) int {
+    count := 0
+    for _, a := range t.items {
+        if a.ProjectID == projectUUID && a.EdgeNodeID != except && live(a) {
+            count++
+        }
+    }
+    return count
+}
+
+// liveAssignment tells whether the edge node is attached to an EdgeAccess,
+// or has just been placed and may still be linking, within the ticket or
+// the candidate lease
+func liveAssignment(a *Assignment) bool {
+    if _, ok := directory.Lookup(a.EdgeNodeID); ok {
+        return true
+    }
+
+    c := liveConf()
+    window := c.TicketTTL
+    if c.CandidateLease > window {
+        window = c.CandidateLease
+    }
+    return time.Since(a.LastSeen) < time.Duration(window)*time.Second
+}
+
+// Delete removes the assignment of the edge node, return false if not found
+func (t *AssignmentTable) Delete(edgeUUID string) bool {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    if _, ok := t.items[edgeUUID]; !ok {
+        return false
+    }
+    delete(t.items, edgeUUID)
+    t.dirty = true
+    return true
+}
+
+var assignments *AssignmentTable
+
+// assignmentLoop writes the changed assignment table every
+// assignment_flush_interval seconds, and expires the stale assignments
+func assignmentLoop() {
+
+    ticker := time.NewTicker(time.Duration(conf.AssignmentFlushInterval)*time.Second)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            if conf.AssignmentTTL > 0 {
+                ttl := time.Duration(conf.AssignmentTTL)*time.Second
+                expired := assignments.Expire(ttl, func(edgeUUID string) bool {
+                    _, ok := directory.Lookup(edgeUUID)
+                    return ok
+                })
+                for _, edgeUUID := range expired {
+                    log.Println("assignment expired", edgeUUID)
+                }
+            }
+            err := assignments.Flush()
+            if err != nil {
+                log.Println("persist assignment table failed", err)
+            }
+        }
+    }
+}
+
+
+// ProjectPools maps the projects to the named pools of EdgeAccess homes,
+// and caps the number of edge nodes assigned in each project. The project
+// not mapped uses the default pool, or the EdgeAccess in no pool if there
+// is no default pool
+type ProjectPools struct {
+    pools       map[string]map[string]bool //pool name to the set of homes
+    projects    map[string]string          //project id to pool name
+    defaultPool string
+    pooled      map[string]string          //home to pool name
+    quotas      map[string]int             //project id to the cap
+}
+
+func NewProjectPools(pools map[string][]string, projects map[string]string,
+                     defaultPool string, quotas map[string]int) (*ProjectPools, error) {
+    p := &ProjectPools{
+        pools:       make(map[string]map[string]bool),
+        projects:    projects,
+        defaultPool: defaultPool,
+        pooled:      make(map[string]string),
+        quotas:      quotas,
+    }
+
+    for name, homes := range pools {
+        p.pools[name] = make(map[string]bool)
+        for _, home := range homes {
+            if other, ok := p.pooled[home]; ok {
+                return nil, errors.New(home + " is in both pool " + other + " and " + name)
+            }
+            p.pools[name][home] = true
+            p.pooled[home] = name
+        }
+    }
+
+    for project, name := range projects {
+        if _, ok := p.pools[name]; !ok {
+            return nil, errors.New("unknown pool " + name + " for project " + project)
+        }
+    }
+    if _, ok := p.pools[defaultPool]; defaultPool != "" && !ok {
+        return nil, errors.New("unknown default pool " + defaultPool)
+    }
+    return p, nil
+}
+
+// PoolOf returns the name of the pool the EdgeAccess home belongs to,
+// empty if it's in no pool
+func (p *ProjectPools) PoolOf(home string) string {
+    return p.pooled[home]
+}
+
+// Allow tells whether the project can use the EdgeAccess home
+func (p *ProjectPools) Allow(projectUUID string, home string) bool {
+    name, ok := p.projects[projectUUID]
+    if !ok {
+        name = p.defaultPool
+    }
+    return p.pooled[home] == name
+}
+
+// Filter returns the EdgeAccess the project can use, in the same order
+func (p *ProjectPools) Filter(projectUUID string, list EdgeAccesses) EdgeAccesses {
+    result := make(EdgeAccesses, 0, len(list))
+    for _, v := range list {
+        if p.Allow(projectUUID, v.EdgeAccessHome) {
+            result = append(result, v)
+        }
+    }
+    return result
+}
+
+// Quota returns the cap of the assigned edge nodes in the project,
+// 0 means no limit
+func (p *ProjectPools) Quota(projectUUID string) int {
+    return p.quotas[projectUUID]
+}
+
+var pools *ProjectPools
+
+
+// DIRECTORY_EVENT is reported by EdgeAccess when an edge node attaches
+// to or detaches from it, Seq increases with each event of the EdgeAccess
+type DIRECTORY_EVENT struct {
+    EdgeNodeID     string `json:"edgenode_id"`
+    EdgeAccessHome string `json:"edgeaccess_home"`
+    Event          string `json:"event"` //attach or detach
+    Seq            uint64 `json:"seq"`
+}
+
+const (
+    DIRECTORY_ATTACH = "attach"
+    DIRECTORY_DETACH = "detach"
+)
+
+// DirectoryEntry tells which EdgeAccess the edge node is attached to
+type DirectoryEntry struct {
+    EdgeNodeID     string    `json:"edgenode_id"`
+    EdgeAccessHome string    `json:"edgeaccess_home"`
+    AttachedAt     time.Time `json:"attached_at"`
+    seq            uint64
+}
+
+// NodeDirectory is the global directory of the attached edge nodes, so
+// that any EdgeAccess can find the one owning the edge node
+type NodeDirectory struct {
+    lock   sync.RWMutex
+    items  map[string]*DirectoryEntry //keyed by edge node id
+}
+
+func NewNodeDirectory() *NodeDirectory {
+    return &NodeDirectory{items: make(map[string]*DirectoryEntry)}
+}
+
+// Apply records the attach or detach event. The events of the same
+// EdgeAccess may arrive out of order, so the one older than the current
+// entry is ignored. The sequence numbers of different EdgeAccess are not
+// comparable, the attach received last wins, and Sync fixes the stale one.
+// A detach only removes the entry of the same EdgeAccess
+func (d *NodeDirectory) Apply(e *DIRECTORY_EVENT) bool {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+
+    cur, ok := d.items[e.EdgeNodeID]
+    same    := ok && cur.EdgeAccessHome == e.EdgeAccessHome
+    if same && e.Seq <= cur.seq {
+        return false
+    }
+
+    switch e.Event {
+    case DIRECTORY_ATTACH:
+        d.items[e.EdgeNodeID] = &DirectoryEntry{
+            EdgeNodeID:     e.EdgeNodeID,
+            EdgeAccessHome: e.EdgeAccessHome,
+            AttachedAt:     time.Now(),
+            seq:            e.Seq,
+        }
+        return true
+    case DIRECTORY_DETACH:
+        if same {
+            delete(d.items, e.EdgeNodeID)
+            return true
+        }
+    }
+    return false
+}
+
+// Sync makes the entries of the EdgeAccess match the edge nodes attached
+// to it as of seq. The entries newer than seq are kept, and the edge node
+// listed but owned by another EdgeAccess is left to that one's sync.
+// Return the edge nodes added and removed
+func (d *NodeDirectory) Sync(home string, attached []string, seq uint64) ([]string, []string) {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+
+    listed  := make(map[string]bool, len(attached))
+    added   := make([]string, 0)
+    removed := make([]string, 0)
+    now     := time.Now()
+    for _, id := range attached {
+        listed[id] = true
+        cur, ok := d.items[id]
+        if !ok {
+            d.items[id] = &DirectoryEntry{
+                EdgeNodeID:     id,
+                EdgeAccessHome: home,
+                AttachedAt:     now,
+                seq:            seq,
+            }
+            added = append(added, id)
+        } else if cur.EdgeAccessHome == home && cur.seq < seq {
+            cur.seq = seq
+        }
+    }
+
+    for id, entry := range d.items {
+        if entry.EdgeAccessHome == home && !listed[id] && entry.seq <= seq {
+            delete(d.items, id)
+            removed = append(removed, id)
+        }
+    }
+    return added, removed
+}
+
+// Lookup returns a copy of the entry of the edge node
+func (d *NodeDirectory) Lookup(edgeUUID string) (DirectoryEntry, bool) {
+    d.lock.RLock()
+    defer d.lock.RUnlock()
+
+    entry, ok := d.items[edgeUUID]
+    if !ok {
+        return DirectoryEntry{}, false
+    }
+    return *entry, true
+}
+
+// List returns a copy of all the entries, sorted by the edge node id
+func (d *NodeDirectory) List() []DirectoryEntry {
+    d.lock.RLock()
+    list := make([]DirectoryEntry, 0, len(d.items))
+    for _, entry := range d.items {
+        list = append(list, *entry)
+    }
+    d.lock.RUnlock()
+
+    sort.Slice(list, func(i, j int) bool { return list[i].EdgeNodeID < list[j].EdgeNodeID })
+    return list
+}
+
+// DropEdgeAccess removes all the entries of the EdgeAccess, e.g. when
+// it's down or removed
+func (d *NodeDirectory) DropEdgeAccess(home string) int {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+
+    count := 0
+    for id, entry := range d.items {
+        if entry.EdgeAccessHome == home {
+            delete(d.items, id)
+            count++
+        }
+    }
+    return count
+}
+
+var directory = NewNodeDirectory()
+
+
+// EVENT is one placement decision or health transition sent to the watchers
+type EVENT struct {
+    ID             uint64          `json:"id"`
+    Type           string          `json:"type"`
+    TimeStamp      int64           `json:"timestamp"`
+    EdgeAccessHome string          `json:"edgeaccess_home,omitempty"`
+    EdgeNodeID     string          `json:"edgenode_id,omitempty"`
+    ProjectID      string          `json:"project_id,omitempty"`
+    EdgeAccess     *EDGEACCESS_URL `json:"edgeaccess,omitempty"`
+    Detail         string          `json:"detail,omitempty"`
+}
+
+const (
+    EVENT_UP           = "edgeaccess_up"
+    EVENT_DOWN         = "edgeaccess_down"
+    EVENT_EJECTED      = "edgeaccess_ejected"
+    EVENT_RECOVERED    = "edgeaccess_recovered"
+    EVENT_REGISTERED   = "edgeaccess_registered"
+    EVENT_DEREGISTERED = "edgeaccess_deregistered"
+    EVENT_EXPIRED      = "edgeaccess_expired"
+    EVENT_CORDON       = "edgeaccess_cordon"
+    EVENT_UNCORDON     = "edgeaccess_uncordon"
+    EVENT_DRAIN        = "edgeaccess_drain"
+    EVENT_ASSIGNMENT   = "assignment"
+)
+
+// EventHub fans out the events to the watchers, a slow watcher misses
+// the events instead of blocking the placement
+type EventHub struct {
+    lock     sync.Mutex
+    lastID   uint64
+    watchers map[chan EVENT]bool
+}
+
+func NewEventHub() *EventHub {
+    return &EventHub{watchers: make(map[chan EVENT]bool)}
+}
+
+func (h *EventHub) Publish(e EVENT) {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    h.lastID++
+    e.ID        = h.lastID
+    e.TimeStamp = time.Now().Unix()
+    for ch := range h.watchers {
+        select {
+        case ch <- e:
+        default:
+            log.Println("watcher is too slow, event dropped", e.ID)
+        }
+    }
+}
+
+func (h *EventHub) Subscribe() chan EVENT {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    ch := make(chan EVENT, 64)
+    h.watchers[ch] = true
+    return ch
+}
+
+func (h *EventHub) Unsubscribe(ch chan EVENT) {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    delete(h.watchers, ch)
+}
+
+var events = NewEventHub()
+
+
+// outcome of the placement requests
+const (
+    OUTCOME_STICKY_HIT    = "sticky_hit"
+    OUTCOME_NEW_PICK      = "new_pick"
+    OUTCOME_NO_CAPACITY   = "no_capacity"
+    OUTCOME_NO_EDGEACCESS = "no_edgeaccess"
+    OUTCOME_REJECTED      = "rejected"
+    OUTCOME_OVER_QUOTA    = "over_quota"
+)
+
+// buckets of the health probe latency histogram, in seconds
+var probeBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics keeps the counters and the histogram exposed on /metrics, the
+// gauges are collected from the registry when being scraped
+type Metrics struct {
+    lock          sync.Mutex
+    requests      map[string]uint64
+    probeFailures uint64
+    probeCounts   []uint64 //count of each bucket, not cumulative
+    probeSum      float64
+    probeCount    uint64
+}
+
+func NewMetrics() *Metrics {
+    m := &Metrics{
+        requests:    make(map[string]uint64),
+        probeCounts: make([]uint64, len(probeBuckets)),
+    }
+    for _, outcome := range []string{OUTCOME_STICKY_HIT, OUTCOME_NEW_PICK,
+                                     OUTCOME_NO_CAPACITY, OUTCOME_NO_EDGEACCESS,
+                                     OUTCOME_REJECTED, OUTCOME_OVER_QUOTA} {
+        m.requests[outcome] = 0
+    }
+    return m
+}
+
+func (m *Metrics) IncRequest(outcome string) {
+    m.lock.Lock()
+    m.requests[outcome]++
+    m.lock.Unlock()
+}
+
+func (m *Metrics) IncProbeFailure() {
+    m.lock.Lock()
+    m.probeFailures++
+    m.lock.Unlock()
+}
+
+func (m *Metrics) ObserveProbe(latency time.Duration) {
+    seconds := latency.Seconds()
+
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    for i, le := range probeBuckets {
+        if seconds <= le {
+            m.probeCounts[i]++
+            break
+        }
+    }
+    m.probeSum += seconds
+    m.probeCount++
+}
+
+// Write writes the counters and the histogram in the prometheus text format
+func (m *Metrics) Write(w io.Writer) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    fmt.Fprintln(w, "# HELP placement_requests_total Placement requests by outcome.")
+    fmt.Fprintln(w, "# TYPE placement_requests_total counter")
+    outcomes := make([]string, 0, len(m.requests))
+    for outcome := range m.requests {
+        outcomes = append(outcomes, outcome)
+    }
+    sort.Strings(outcomes)
+    for _, outcome := range outcomes {
+        fmt.Fprintf(w, "placement_requests_total{outcome=\"%s\"} %d\n",
+                    outcome, m.requests[outcome])
+    }
+
+    fmt.Fprintln(w, "# HELP placement_health_probe_failures_total Failed health probes.")
+    fmt.Fprintln(w, "# TYPE placement_health_probe_failures_total counter")
+    fmt.Fprintf(w, "placement_health_probe_failures_total %d\n", m.probeFailures)
+
+    fmt.Fprintln(w, "# HELP placement_health_probe_duration_seconds Latency of the succeeded health probes.")
+    fmt.Fprintln(w, "# TYPE placement_health_probe_duration_seconds histogram")
+    var cumulative uint64
+    for i, le := range probeBuckets {
+        cumulative += m.probeCounts[i]
+        fmt.Fprintf(w, "placement_health_probe_duration_seconds_bucket{le=\"%s\"} %d\n",
+                    strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+    }
+    fmt.Fprintf(w, "placement_health_probe_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.probeCount)
+    fmt.Fprintf(w, "placement_health_probe_duration_seconds_sum %g\n", m.probeSum)
+    fmt.Fprintf(w, "placement_health_probe_duration_seconds_count %d\n", m.probeCount)
+}
+
+var metrics = NewMetrics()
+
+// escapeLabel escapes the label value for the prometheus text format
+func escapeLabel(v string) string {
+    v = strings.Replace(v, "\\", "\\\\", -1)
+    v = strings.Replace(v, "\"", "\\\"", -1)
+    return strings.Replace(v, "\n", "\\n", -1)
+}
+
+// metricsHandler exposes the gauges of each EdgeAccess, and the counters
+// and histogram of placement for prometheus
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+    now  := time.Now()
+    list := listEdgeAccess.Snapshot()
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+    fmt.Fprintln(w, "# HELP placement_edgeaccess_connections Connection number reported by the EdgeAccess.")
+    fmt.Fprintln(w, "# TYPE placement_edgeaccess_connections gauge")
+    for _, v := range list {
+        fmt.Fprintf(w, "placement_edgeaccess_connections{edgeaccess=\"%s\"} %d\n",
+                    escapeLabel(v.EdgeAccessHome), v.PingResp.ConnNum)
+    }
+
+    fmt.Fprintln(w, "# HELP placement_edgeaccess_max_connections Maximum connection number of the EdgeAccess, 0 means no limit.")
+    fmt.Fprintln(w, "# TYPE placement_edgeaccess_max_connections gauge")
+    for _, v := range list {
+        fmt.Fprintf(w, "placement_edgeaccess_max_connections{edgeaccess=\"%s\"} %d\n",
+                    escapeLabel(v.EdgeAccessHome), v.PingResp.MaxConn)
+    }
+
+    fmt.Fprintln(w, "# HELP placement_edgeaccess_alive Whether the EdgeAccess is alive.")
+    fmt.Fprintln(w, "# TYPE placement_edgeaccess_alive gauge")
+    for _, v := range list {
+        alive := 0
+        if isAlive(&v, now) {
+            alive = 1
+        }
+        fmt.Fprintf(w, "placement_edgeaccess_alive{edgeaccess=\"%s\"} %d\n",
+                    escapeLabel(v.EdgeAccessHome), alive)
+    }
+
+    fmt.Fprintln(w, "# HELP placement_edgeaccess_seconds_since_last_response Seconds since the last response of the EdgeAccess.")
+    fmt.Fprintln(w, "# TYPE placement_edgeaccess_seconds_since_last_response gauge")
+    for _, v := range list {
+        fmt.Fprintf(w, "placement_edgeaccess_seconds_since_last_response{edgeaccess=\"%s\"} %g\n",
+                    escapeLabel(v.EdgeAccessHome), now.Sub(v.LastResponse).Seconds())
+    }
+
+    metrics.Write(w)
+}
+
+
+// EdgeNode is a known edge node allowed to ask for an EdgeAccess
+type EdgeNode struct {
+    ProjectID      string            `json:"project_id"`
+    EdgeNodeID     string            `json:"edgenode_id"`
+    Labels         map[string]string `json:"labels"`
+    Enabled        bool              `json:"enabled"`
+}
+
+// NodeRegistry keeps the known edge nodes, and persists them to a local
+// file on every change
+type NodeRegistry struct {
+    lock   sync.RWMutex
+    path   string
+    items  map[string]*EdgeNode //keyed by edge node id
+}
+
+func NewNodeRegistry(path string) *NodeRegistry {
+    return &NodeRegistry{
+        path:  path,
+        items: make(map[string]*EdgeNode),
+    }
+}
+
+// Load reads the nodes from the local file, a missing file is not an error
+func (n *NodeRegistry) Load() error {
+    items := make(map[string]*EdgeNode)
+    err := loadJSONFile(n.path, &items)
+    if err != nil {
+        return err
+    }
+
+    n.lock.Lock()
+    n.items = items
+    n.lock.Unlock()
+    return nil
+}
+
+// Get returns a copy of the edge node
+func (n *NodeRegistry) Get(edgeUUID string) (EdgeNode, bool) {
+    n.lock.RLock()
+    defer n.lock.RUnlock()
+
+    node, ok := n.items[edgeUUID]
+    if !ok {
+        return EdgeNode{}, false
+    }
+    return *node, true
+}
+
+// List returns a copy of the edge nodes in the project, or all the edge
+// nodes if projectUUID is empty
+func (n *NodeRegistry) List(projectUUID string) []EdgeNode {
+    n.lock.RLock()
+    defer n.lock.RUnlock()
+
+    list := make([]EdgeNode, 0, len(n.items))
+    for _, node := range n.items {
+        if projectUUID == "" || node.ProjectID == projectUUID {
+            list = append(list, *node)
+        }
+    }
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].EdgeNodeID < list[j].EdgeNodeID
+    })
+    return list
+}
+
+// Put adds or replaces the edge node, return true if it's a new one
+func (n *NodeRegistry) Put(node *EdgeNode) (bool, error) {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+
+    _, exist := n.items[node.EdgeNodeID]
+    copied := *node
+    n.items[node.EdgeNodeID] = &copied
+    return !exist, saveJSONFile(n.path, n.items)
+}
+
+// Delete removes the edge node, return false if not found
+func (n *NodeRegistry) Delete(edgeUUID string) (bool, error) {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+
+    if _, ok := n.items[edgeUUID]; !ok {
+        return false, nil
+    }
+    delete(n.items, edgeUUID)
+    return true, saveJSONFile(n.path, n.items)
+}
+
+// Validate checks the edge node is known, enabled, and belongs to the project
+func (n *NodeRegistry) Validate(projectUUID string, edgeUUID string) error {
+    node, ok := n.Get(edgeUUID)
+    if !ok {
+        return errors.New("unknown edge node " + edgeUUID)
+    }
+    if node.ProjectID != projectUUID {
+        return errors.New("edge node " + edgeUUID + " not in project " + projectUUID)
+    }
+    if !node.Enabled {
+        return errors.New("edge node " + edgeUUID + " is disabled")
+    }
+    return nil
+}
+
+var nodes *NodeRegistry
+
+
+type CONFIGURATION struct {
+    Host string `json:"host"`
+    Port string `json:"port"`
+
+    PingInterval int `json:"ping_interval"`
+    HeartBroken  int `json:"hearbroken_interval"`
+
+    //a list of EdgeAccess home url
+    EdgeAccessHomes []string `json:"edgeaccess_homes"`
+
+    //registered EdgeAccess will be removed if not renewed in time,
+    //hearbroken_interval is used if not set
+    RegisterTTL int `json:"register_ttl"`
+
+    //strategy to select a new EdgeAccess: least_conn, weighted_round_robin,
+    //consistent_hash or random_two, least_conn by default
+    Strategy string `json:"strategy"`
+    //weight of each EdgeAccess home for weighted_round_robin
+    EdgeAccessWeights map[string]int `json:"edgeaccess_weights"`
+
+    //seconds for edged to wait before asking again when all EdgeAccess
+    //are saturated, ping_interval is used if not set
+    RetryAfter int `json:"retry_after"`
+
+    //local file to persist the edge node to EdgeAccess assignment table,
+    //the table is kept in memory only if not set
+    AssignmentStore string `json:"assignment_store"`
+
+    //local file to persist the cordoned edgeaccess homes, so that they
+    //stay cordoned after expiry or restart. In memory only if not set
+    CordonStore string `json:"cordon_store"`
+
+    //seconds to write the changed assignment table, 5 if not set. The
+    //assignment not seen for assignment_ttl seconds is dropped unless the
+    //edge node is still attached, 86400 if not set, negative to keep all
+    AssignmentFlushInterval int `json:"assignment_flush_interval"`
+    AssignmentTTL int `json:"assignment_ttl"`
+
+    //reject the unknown or disabled edge node if node_validation is true,
+    //the known edge nodes are persisted in node_store, edge_nodes are
+    //added to it on startup if not there yet
+    NodeValidation bool `json:"node_validation"`
+    NodeStore string `json:"node_store"`
+    EdgeNodes []EdgeNode `json:"edge_nodes"`
+
+    //rebalance the live EdgeAccess every rebalance_interval seconds, 0 to
+    //disable it. One is overloaded if its connection number is over the
+    //average by rebalance_threshold (0.2 means 20%), and is asked to hand
+    //back at most rebalance_max_sessions sessions each round
+    RebalanceInterval int `json:"rebalance_interval"`
+    RebalanceThreshold float64 `json:"rebalance_threshold"`
+    RebalanceMaxSessions int `json:"rebalance_max_sessions"`
+
+    //seconds to wait for the ping response, ping_interval if not set
+    ProbeTimeout int `json:"probe_timeout"`
+    //consecutive failed probes to mark an EdgeAccess down, 3 if not set,
+    //and consecutive succeeded probes to mark it up, 1 if not set
+    FailThreshold int `json:"fail_threshold"`
+    SuccessThreshold int `json:"success_threshold"`
+    //eject the EdgeAccess whose average ping latency is over outlier_factor
+    //times of the median and over outlier_min_latency milliseconds, for
+    //eject_duration seconds, at most max_eject_percent of them, 0
+    //outlier_factor to disable it
+    OutlierFactor float64 `json:"outlier_factor"`
+    OutlierMinLatency int `json:"outlier_min_latency"`
+    EjectDuration int `json:"eject_duration"`
+    MaxEjectPercent int `json:"max_eject_percent"`
+
+    //number of candidates returned by /v1.1/edgeaccess including the
+    //primary one, 3 if not set, and the lease of them in seconds,
+    //hearbroken_interval if not set
+    CandidateNum int `json:"candidate_num"`
+    CandidateLease int `json:"candidate_lease"`
+
+    //named pools of EdgeAccess homes, and the pool of each project. The
+    //project not in project_pools uses default_pool, or the EdgeAccess
+    //in no pool if default_pool is not set
+    Pools map[string][]string `json:"pools"`
+    ProjectPools map[string]string `json:"project_pools"`
+    DefaultPool string `json:"default_pool"`
+    //maximum number of edge nodes assigned in each project
+    ProjectQuotas map[string]int `json:"project_quotas"`
+
+    //regions ordered by the distance from each region, used to fall back
+    //to the nearest region if no EdgeAccess in the same region
+    NearestRegions map[string][]string `json:"nearest_regions"`
+
+    //seconds to check whether the configuration file is changed, 5 if not
+    //set, negative to reload on SIGHUP only
+    ConfigWatchInterval int `json:"config_watch_interval"`
+
+    //key shared with EdgeAccess to sign the placement tickets, no ticket
+    //is issued if not set. The ticket is valid for ticket_ttl seconds
+    TicketKey string `json:"ticket_key"`
+    TicketTTL int `json:"ticket_ttl"`
+
+    //token required in the admin_token header by the endpoints changing
+    //the fleet: edgeaccess registration, the directory events, the edge
+    //node changes and the cordon. They are refused if not set. It's also
+    //sent to edgeaccess to ask for rebalance
+    AdminToken string `json:"admin_token"`
+}
+
+// global variables used in this file
+var conf CONFIGURATION
+var confFile string
+var confLock sync.RWMutex
+var healthReset = make(chan bool, 1)
+var selectStrategy SelectStrategy
+
+var errNoEdgeAccess = errors.New("Error in finding proper edgeaccess")
+var errNoCapacity   = errors.New("all edgeaccess reach the maximum connection")
+var errOverQuota    = errors.New("project reaches the quota of edge nodes")
+
+
+/* note: error and  exception are not carefully handled here */
+
+func main() {
+
+    if initConfAndVar(&conf) != nil {
+        return
+    }
+
+    http.HandleFunc("/v1.0/edgeaccess", edgeAccessHandler)
+    http.HandleFunc("/v1.1/edgeaccess", edgeAccessCandidatesHandler)
+    http.HandleFunc("/v1.0/edgeaccess/register", registerHandler)
+    http.HandleFunc("/v1.0/assignment", assignmentHandler)
+    http.HandleFunc("/v1.0/nodes", nodesHandler)
+    http.HandleFunc("/v1.0/nodes/", nodeHandler)
+    http.HandleFunc("/v1.0/admin/edgeaccess", adminEdgeAccessHandler)
+    http.HandleFunc("/v1.0/admin/edgeaccess/cordon", adminCordonHandler)
+    http.HandleFunc("/v1.0/admin/edgeaccess/uncordon", adminCordonHandler)
+    http.HandleFunc("/v1.0/watch", watchHandler)
+    http.HandleFunc("/v1.0/directory", directoryHandler)
+    http.HandleFunc("/v1.0/directory/", directoryLookupHandler)
+    http.HandleFunc("/metrics", metricsHandler)
+
+    go healthCollect()
+    go watchConf()
+    go assignmentLoop()
+
+    if conf.RebalanceInterval > 0 {
+        go rebalanceLoop()
+    }
+
+    //use https instead
+    http.ListenAndServe(conf.Host+":"+conf.Port, nil)
+}
+
+func initConfAndVar(conf *CONFIGURATION) error {
+
+    //load CLI parameters and configuration
+    flag.StringVar(&confFile, "f", "placement.conf", "path for configuration file")
+    flag.Parse()
+
+    err  := getConfig(conf, confFile)
+    if err != nil {
+        log.Println("read configuration failed: ", err)
+        return err
+    }
+
+    if conf.ConfigWatchInterval == 0 {
+        conf.ConfigWatchInterval = 5
+    }
+    setTimingDefaults(conf)
+
+    log.Println("configuration conf.Host", conf.Host)
+    log.Println("configuration conf.Port", conf.Port)
+    log.Println("configuration conf.PingInterval", conf.PingInterval)
+    log.Println("configuration conf.HeartBroken", conf.HeartBroken)
+    log.Println("configuration conf.EdgeAccessHomes", conf.EdgeAccessHomes)
+    log.Println("configuration conf.ConfigWatchInterval", conf.ConfigWatchInterval)
+    log.Println("configuration conf.RegisterTTL", conf.RegisterTTL)
+    log.Println("configuration conf.Strategy", conf.Strategy)
+    log.Println("configuration conf.EdgeAccessWeights", conf.EdgeAccessWeights)
+
+    log.Println("configuration conf.RetryAfter", conf.RetryAfter)
+
+    selectStrategy, err = newSelectStrategy(conf.Strategy, conf.EdgeAccessWeights)
+    if err != nil {
+        log.Println("invalid strategy: ", err)
+        return err
+    }
+
+    if conf.RebalanceMaxSessions <= 0 {
+        conf.RebalanceMaxSessions = 10
+    }
+    log.Println("configuration conf.RebalanceInterval", conf.RebalanceInterval)
+    log.Println("configuration conf.RebalanceThreshold", conf.RebalanceThreshold)
+    log.Println("configuration conf.RebalanceMaxSessions", conf.RebalanceMaxSessions)
+
+    if conf.FailThreshold <= 0 {
+        conf.FailThreshold = 3
+    }
+    if conf.SuccessThreshold <= 0 {
+        conf.SuccessThreshold = 1
+    }
+    if conf.EjectDuration <= 0 {
+        conf.EjectDuration = 30
+    }
+    if conf.MaxEjectPercent <= 0 {
+        conf.MaxEjectPercent = 50
+    }
+    log.Println("configuration conf.ProbeTimeout", conf.ProbeTimeout)
+    log.Println("configuration conf.FailThreshold", conf.FailThreshold)
+    log.Println("configuration conf.SuccessThreshold", conf.SuccessThreshold)
+    log.Println("configuration conf.OutlierFactor", conf.OutlierFactor)
+    log.Println("configuration conf.OutlierMinLatency", conf.OutlierMinLatency)
+    log.Println("configuration conf.EjectDuration", conf.EjectDuration)
+    log.Println("configuration conf.MaxEjectPercent", conf.MaxEjectPercent)
+
+    if conf.CandidateNum <= 0 {
+        conf.CandidateNum = 3
+    }
+    log.Println("configuration conf.CandidateNum", conf.CandidateNum)
+    log.Println("configuration conf.CandidateLease", conf.CandidateLease)
+
+    log.Println("configuration conf.Pools", conf.Pools)
+    log.Println("configuration conf.ProjectPools", conf.ProjectPools)
+    log.Println("configuration conf.DefaultPool", conf.DefaultPool)
+    log.Println("configuration conf.ProjectQuotas", conf.ProjectQuotas)
+
+    pools, err = NewProjectPools(conf.Pools, conf.ProjectPools,
+                                 conf.DefaultPool, conf.ProjectQuotas)
+    if err != nil {
+        log.Println("invalid pools: ", err)
+        return err
+    }
+
+    log.Println("configuration conf.NearestRegions", conf.NearestRegions)
+
+    if conf.TicketTTL <= 0 {
+        conf.TicketTTL = 60
+    }
+    log.Println("configuration conf.TicketKey set", conf.TicketKey != "")
+    log.Println("configuration conf.TicketTTL", conf.TicketTTL)
+    log.Println("configuration conf.AdminToken set", conf.AdminToken != "")
+
+    if conf.AssignmentFlushInterval <= 0 {
+        conf.AssignmentFlushInterval = 5
+    }
+    if conf.AssignmentTTL == 0 {
+        conf.AssignmentTTL = 86400
+    }
+    log.Println("configuration conf.AssignmentStore", conf.AssignmentStore)
+    log.Println("configuration conf.AssignmentFlushInterval", conf.AssignmentFlushInterval)
+    log.Println("configuration conf.AssignmentTTL", conf.AssignmentTTL)
+
+    log.Println("configuration conf.CordonStore", conf.CordonStore)
+
+    // global varibles initialization
+    err = initEdgeAccessList()
+    if err != nil {
+        log.Println("load cordoned edgeaccess failed: ", err)
+        return err
+    }
+
+    assignments = NewAssignmentTable(conf.AssignmentStore)
+    err = assignments.Load()
+    if err != nil {
+        log.Println("load assignment table failed: ", err)
+        return err
+    }
+
+    log.Println("configuration conf.NodeValidation", conf.NodeValidation)
+    log.Println("configuration conf.NodeStore", conf.NodeStore)
+
+    err = initNodeRegistry()
+    if err != nil {
+        log.Println("init node registry failed: ", err)
+        return err
+    }
+
+    return nil
+}
+
+func initEdgeAccessList() error {
+    listEdgeAccess = NewEdgeAccessRegistry(newHealthPolicy())
+
+    for _, v := range conf.EdgeAccessHomes {
+        listEdgeAccess.Add(v, true)
+    }
+
+    err := listEdgeAccess.LoadCordons(conf.CordonStore)
+    if err != nil {
+        return err
+    }
+
+    log.Println("listEdgeAccess:", listEdgeAccess.Snapshot())
+    return nil
+}
+
+func initNodeRegistry() error {
+    nodes = NewNodeRegistry(conf.NodeStore)
+    err  := nodes.Load()
+    if err != nil {
+        return err
+    }
+
+    for i, v := range conf.EdgeNodes {
+        if _, ok := nodes.Get(v.EdgeNodeID); ok {
+            continue
+        }
+        _, err = nodes.Put(&conf.EdgeNodes[i])
+        if err != nil {
+            return err
+        }
+    }
+
+    log.Println("nodes:", nodes.List(""))
+    return nil
+}
+
+// setTimingDefaults sets the timing settings derived from ping_interval
+// and hearbroken_interval if they are not set
+func setTimingDefaults(c *CONFIGURATION) {
+    if c.RegisterTTL <= 0 {
+        c.RegisterTTL = c.HeartBroken
+    }
+    if c.RetryAfter <= 0 {
+        c.RetryAfter = c.PingInterval
+    }
+    if c.ProbeTimeout <= 0 {
+        c.ProbeTimeout = c.PingInterval
+    }
+    if c.CandidateLease <= 0 {
+        c.CandidateLease = c.HeartBroken
+    }
+}
+
+// liveConf returns a copy of the configuration, the settings changed by
+// reloadConf should only be read through it
+func liveConf() CONFIGURATION {
+    confLock.RLock()
+    defer confLock.RUnlock()
+    return conf
+}
+
+// reloadConf reads the configuration file again, applies the new
+// edgeaccess_homes, ping_interval, hearbroken_interval and the timing
+// settings derived from them, and reconciles the static EdgeAccess
+// without losing the health state of the unchanged ones. The other
+// settings need a restart
+func reloadConf() error {
+    var newConf CONFIGURATION
+    err := getConfig(&newConf, confFile)
+    if err != nil {
+        return err
+    }
+    if newConf.PingInterval <= 0 || newConf.HeartBroken <= 0 {
+        return errors.New("ping_interval and hearbroken_interval should be positive")
+    }
+    setTimingDefaults(&newConf)
+
+    confLock.Lock()
+    conf.EdgeAccessHomes = newConf.EdgeAccessHomes
+    conf.PingInterval    = newConf.PingInterval
+    conf.HeartBroken     = newConf.HeartBroken
+    conf.RegisterTTL     = newConf.RegisterTTL
+    conf.RetryAfter      = newConf.RetryAfter
+    conf.ProbeTimeout    = newConf.ProbeTimeout
+    conf.CandidateLease  = newConf.CandidateLease
+    confLock.Unlock()
+
+    log.Println("reload conf.PingInterval", newConf.PingInterval)
+    log.Println("reload conf.HeartBroken", newConf.HeartBroken)
+    log.Println("reload conf.EdgeAccessHomes", newConf.EdgeAccessHomes)
+
+    added, removed := listEdgeAccess.Reconcile(newConf.EdgeAccessHomes)
+    for _, home := range added {
+        log.Println("EdgeAccess added by reload", home)
+        events.Publish(EVENT{Type: EVENT_REGISTERED, EdgeAccessHome: home,
+                             Detail: "reload"})
+    }
+    for _, home := range removed {
+        log.Println("EdgeAccess removed by reload", home)
+        directory.DropEdgeAccess(home)
+        events.Publish(EVENT{Type: EVENT_DEREGISTERED, EdgeAccessHome: home,
+                             Detail: "reload"})
+    }
+
+    // reset the ticker of healthCollect to the new interval
+    select {
+    case healthReset <- true:
+    default:
+    }
+    return nil
+}
+
+// watchConf reloads the configuration on SIGHUP, or when the file is
+// changed, the modification time is checked every config_watch_interval
+// seconds, negative to disable it
+func watchConf() {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+
+    var poll <-chan time.Time
+    if conf.ConfigWatchInterval > 0 {
+        ticker := time.NewTicker(time.Duration(conf.ConfigWatchInterval)*time.Second)
+        defer ticker.Stop()
+        poll = ticker.C
+    }
+
+    var lastMod time.Time
+    if info, err := os.Stat(confFile); err == nil {
+        lastMod = info.ModTime()
+    }
+
+    for {
+        select {
+        case <-hup:
+            log.Println("SIGHUP received, reload", confFile)
+        case <-poll:
+            info, err := os.Stat(confFile)
+            if err != nil || !info.ModTime().After(lastMod) {
+                continue
+            }
+            lastMod = info.ModTime()
+            log.Println("configuration changed, reload", confFile)
+        }
+
+        err := reloadConf()
+        if err != nil {
+            log.Println("reload configuration failed: ", err)
+        }
+    }
+}
+
+func newHealthPolicy() HealthPolicy {
+    return HealthPolicy{
+        FailThreshold:     conf.FailThreshold,
+        SuccessThreshold:  conf.SuccessThreshold,
+        OutlierFactor:     conf.OutlierFactor,
+        OutlierMinLatency: time.Duration(conf.OutlierMinLatency)*time.Millisecond,
+        EjectDuration:     time.Duration(conf.EjectDuration)*time.Second,
+        MaxEjectPercent:   conf.MaxEjectPercent,
+    }
+}
+
+func getConfig( config *CONFIGURATION, f string) error {
+    file, _ := os.Open(f)
+    defer file.Close()
+
+    decoder := json.NewDecoder(file)
+    err := decoder.Decode(config)
+    return err
+}
+
+// registerHandler serves the self-registration of edgeaccess,
+// POST to register or renew, DELETE to deregister
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+    if !checkAdminToken(w, r) {
+        return
+    }
+
+    if r.Body == nil {
+        http.Error(w, "Please send a request body", 400)
+        return
+    }
+
+    var reg EDGEACCESS_REGISTER
+    err := json.NewDecoder(r.Body).Decode(&reg)
+    if err != nil {
+        http.Error(w, err.Error(), 400)
+        return
+    }
+
+    if reg.EdgeAccessHome == "" {
+        http.Error(w, "edgeaccess_home is required", 400)
+        return
+    }
+
+    switch r.Method {
+    case "POST":
+        if listEdgeAccess.Register(reg.EdgeAccessHome, &reg.PingResp) {
+            log.Println("EdgeAccess registered", reg.EdgeAccessHome)
+            events.Publish(EVENT{Type: EVENT_REGISTERED,
+                                 EdgeAccessHome: reg.EdgeAccessHome})
+        }
+        if reg.Attached != nil {
+            syncDirectory(reg.EdgeAccessHome, reg.Attached, reg.Seq)
+        }
+        w.WriteHeader(http.StatusOK)
+    case "DELETE":
+        if !listEdgeAccess.Remove(reg.EdgeAccessHome) {
+            http.Error(w, "EdgeAccess not found", 404)
+            return
+        }
+        log.Println("EdgeAccess deregistered", reg.EdgeAccessHome)
+        directory.DropEdgeAccess(reg.EdgeAccessHome)
+        events.Publish(EVENT{Type: EVENT_DEREGISTERED,
+                             EdgeAccessHome: reg.EdgeAccessHome})
+        w.WriteHeader(http.StatusOK)
+    default:
+        http.Error(w, "method not allowed", 405)
+    }
+}
+
+// checkAdminToken answers 401 and returns false unless the admin_token
+// header matches the configured one, 403 if admin_token is not set
+func checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+    if conf.AdminToken == "" {
+        http.Error(w, "admin_token is not configured", 403)
+        return false
+    }
+    if !hmac.Equal([]byte(r.Header.Get("admin_token")), []byte(conf.AdminToken)) {
+        http.Error(w, "invalid admin_token", 401)
+        return false
+    }
+    return true
+}
+
+func edgeAccessHandler(w http.ResponseWriter, r *http.Request) {
+    var newEU EDGEACCESS_URL
+    if !placeEdgeNode(w, r, &newEU) {
+        return
+    }
+
+    expire := time.Now().Add(time.Duration(conf.TicketTTL)*time.Second).Unix()
+    newEU.Ticket = signTicket(r.Header.Get("edgenode_id"),
+                              r.Header.Get("project_id"), &newEU, expire)
+
+    json.NewEncoder(w).Encode(&newEU)
+}
+
+// edgeAccessCandidatesHandler serves /v1.1/edgeaccess, it returns the
+// primary EdgeAccess and the fallbacks in order, each one with a lease,
+// so that edged can walk the list before going back to placement
+func edgeAccessCandidatesHandler(w http.ResponseWriter, r *http.Request) {
+    var newEU EDGEACCESS_URL
+    if !placeEdgeNode(w, r, &newEU) {
+        return
+    }
+
+    // the tickets are valid as long as the lease
+    edgeUUID    := r.Header.Get("edgenode_id")
+    projectUUID := r.Header.Get("project_id")
+    labels      := nodeLabels(r)
+    lease       := time.Now().Add(time.Duration(liveConf().CandidateLease)*time.Second).Unix()
+
+    result := EDGEACCESS_CANDIDATES{}
+    newEU.Ticket = signTicket(edgeUUID, projectUUID, &newEU, lease)
+    result.Candidates = append(result.Candidates,
+        EDGEACCESS_CANDIDATE{newEU, CANDIDATE_PRIMARY, lease})
+    for _, v := range listFallbackEdgeAccess(projectUUID, labels, &newEU, conf.CandidateNum-1) {
+        v.Ticket = signTicket(edgeUUID, projectUUID, &v, lease)
+        result.Candidates = append(result.Candidates,
+            EDGEACCESS_CANDIDATE{v, CANDIDATE_FALLBACK, lease})
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(&result)
+}
+
+// signTicket signs the ticket for the edge node to link to the EdgeAccess
+// until expire, as base64(json).base64(hmac-sha256). Empty if no ticket_key
+func signTicket(edgeUUID string, projectUUID string, ea *EDGEACCESS_URL, expire int64) string {
+    if conf.TicketKey == "" {
+        return ""
+    }
+
+    ticket := PLACEMENT_TICKET{
+        EdgeNodeID: edgeUUID,
+        ProjectID:  projectUUID,
+        EdgeAccess: ea.Host + ":" + ea.Port,
+        Expire:     expire,
+    }
+    payload, _ := json.Marshal(&ticket)
+
+    mac := hmac.New(sha256.New, []byte(conf.TicketKey))
+    mac.Write(payload)
+    return base64.RawURLEncoding.EncodeToString(payload) + "." +
+           base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// nodeLabels returns the location labels sent by edged in the
+// edgenode_labels header as "region=r1,zone=z1", or the labels in the
+// node registry if edged sends none
+func nodeLabels(r *http.Request) map[string]string {
+    labels := make(map[string]string)
+    for _, kv := range strings.Split(r.Header.Get("edgenode_labels"), ",") {
+        pair := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+        if len(pair) == 2 && pair[0] != "" {
+            labels[pair[0]] = pair[1]
+        }
+    }
+
+    if len(labels) == 0 {
+        if node, ok := nodes.Get(r.Header.Get("edgenode_id")); ok && node.Labels != nil {
+            return node.Labels
+        }
+    }
+    return labels
+}
+
+// placeEdgeNode validates the edge node, finds the EdgeAccess for it and
+// records the assignment. The error is written back and false is returned
+// if it fails
+func placeEdgeNode(w http.ResponseWriter, r *http.Request, newEU *EDGEACCESS_URL) bool {
+    // extract the project-id and edge node id from cert
+    // now we just extract edge node id from the header
+    edgeUUID    := r.Header.Get("edgenode_id")
+    projectUUID := r.Header.Get("project_id")
+
+    log.Println("receive request from", projectUUID, edgeUUID)
+
+    if conf.NodeValidation {
+        err := nodes.Validate(projectUUID, edgeUUID)
+        if err != nil {
+            log.Println("node validation failed:", err)
+            metrics.IncRequest(OUTCOME_REJECTED)
+            http.Error(w, err.Error(), 403)
+            return false
+        }
+    }
+
+    var lastEU EDGEACCESS_URL
+    if r.Body == nil {
+        http.Error(w, "Please send a request body", 400)
+        return false
+    }
+    err := json.NewDecoder(r.Body).Decode(&lastEU)
+    if err != nil {
+        http.Error(w, err.Error(), 400)
+        return false
+    }
+
+    // edged asked to reconnect by the rebalance should go to a new one,
+    // not back to the one handing it back
+    rebalanced := r.Header.Get("reconnect_reason") == RECONNECT_REBALANCE
+    var drained EDGEACCESS_URL
+    if rebalanced {
+        if a, ok := assignments.Get(edgeUUID); ok {
+            drained = a.EdgeAccess
+        }
+        lastEU = EDGEACCESS_URL{}
+    }
+
+    // edged loses the last EdgeAccess after restart, so the recorded
+    // assignment is used for the sticky affinity instead
+    if lastEU.Host == "" && edgeUUID != "" && !rebalanced {
+        if a, ok := assignments.Get(edgeUUID); ok {
+            lastEU = a.EdgeAccess
+        }
+    }
+
+    // only the edge nodes attached or just placed are counted, and the
+    // edge node already assigned is not counted again. It's checked again
+    // when the assignment is recorded
+    quota := pools.Quota(projectUUID)
+    if quota > 0 && assignments.CountProject(projectUUID, edgeUUID, liveAssignment) >= quota {
+        rejectOverQuota(w, projectUUID, quota)
+        return false
+    }
+
+    err = getNewEdgeAccess(edgeUUID, projectUUID, nodeLabels(r),
+                           lastEU.Host, lastEU.Port, &drained, newEU)
+
+    if err == errNoCapacity {
+        w.Header().Set("Retry-After", strconv.Itoa(liveConf().RetryAfter))
+        http.Error(w, "all EdgeAccess are saturated, try again later", 503)
+        return false
+    }
+    if err != nil {
+        http.Error(w, "no EdgeAccess is available, try again later", 404)
+        return false
+    }
+
+    if edgeUUID != "" {
+        changed, err := assignments.Set(edgeUUID, projectUUID, newEU, quota, liveAssignment)
+        if err == errOverQuota {
+            rejectOverQuota(w, projectUUID, quota)
+            return false
+        }
+
+        detail := "kept"
+        if changed {
+            detail = "changed"
+        }
+        events.Publish(EVENT{Type: EVENT_ASSIGNMENT,
+                             EdgeNodeID: edgeUUID,
+                             ProjectID: projectUUID,
+                             EdgeAccess: newEU,
+                             Detail: detail})
+    }
+    return true
+}
+
+func rejectOverQuota(w http.ResponseWriter, projectUUID string, quota int) {
+    log.Println("project", projectUUID, "reaches the quota", quota)
+    metrics.IncRequest(OUTCOME_OVER_QUOTA)
+    w.Header().Set("Retry-After", strconv.Itoa(liveConf().RetryAfter))
+    http.Error(w, errOverQuota.Error(), 429)
+}
+
+// nodesHandler lists the edge nodes with GET, optionally filtered by the
+// project_id query, and creates one with POST
+func nodesHandler(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "GET":
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(nodes.List(r.URL.Query().Get("project_id")))
+    case "POST":
+        if !checkAdminToken(w, r) {
+            return
+        }
+        var node EdgeNode
+        if r.Body == nil {
+            http.Error(w, "Please send a request body", 400)
+            return
+        }
+        err := json.NewDecoder(r.Body).Decode(&node)
+        if err != nil {
+            http.Error(w, err.Error(), 400)
+            return
+        }
+        if node.EdgeNodeID == "" || node.ProjectID == "" {
+            http.Error(w, "edgenode_id and project_id are required", 400)
+            return
+        }
+        if _, ok := nodes.Get(node.EdgeNodeID); ok {
+            http.Error(w, "edge node exists already", 409)
+            return
+        }
+        _, err = nodes.Put(&node)
+        if err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        log.Println("edge node created", node)
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(&node)
+    default:
+        http.Error(w, "method not allowed", 405)
+    }
+}
+
+// nodeHandler serves /v1.0/nodes/{edgenode_id}, GET to read, PUT to
+// replace and DELETE to remove the edge node
+func nodeHandler(w http.ResponseWriter, r *http.Request) {
+    edgeUUID := strings.TrimPrefix(r.URL.Path, "/v1.0/nodes/")
+    if edgeUUID == "" || strings.Contains(edgeUUID, "/") {
+        http.Error(w, "invalid edge node id", 400)
+        return
+    }
+
+    switch r.Method {
+    case "GET":
+        node, ok := nodes.Get(edgeUUID)
+        if !ok {
+            http.Error(w, "edge node not found", 404)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(&node)
+    case "PUT":
+        if !checkAdminToken(w, r) {
+            return
+        }
+        var node EdgeNode
+        if r.Body == nil {
+            http.Error(w, "Please send a request body", 400)
+            return
+        }
+        err := json.NewDecoder(r.Body).Decode(&node)
+        if err != nil {
+            http.Error(w, err.Error(), 400)
+            return
+        }
+        if node.ProjectID == "" {
+            http.Error(w, "project_id is required", 400)
+            return
+        }
+        node.EdgeNodeID = edgeUUID
+        _, err = nodes.Put(&node)
+        if err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        log.Println("edge node updated", node)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(&node)
+    case "DELETE":
+        if !checkAdminToken(w, r) {
+            return
+        }
+        found, err := nodes.Delete(edgeUUID)
+        if err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        if !found {
+            http.Error(w, "edge node not found", 404)
+            return
+        }
+        // release the assignment, so it's not counted in the quota
+        assignments.Delete(edgeUUID)
+        log.Println("edge node deleted", edgeUUID)
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        http.Error(w, "method not allowed", 405)
+    }
+}
+
+// assignmentHandler returns the assignment of the edge node given by
+// the edgenode_id query, or all the assignments without it
+func assignmentHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+
+    edgeUUID := r.URL.Query().Get("edgenode_id")
+
+    w.Header().Set("Content-Type", "application/json")
+    if edgeUUID == "" {
+        json.NewEncoder(w).Encode(assignments.List())
+        return
+    }
+
+    a, ok := assignments.Get(edgeUUID)
+    if !ok {
+        http.Error(w, "no assignment for " + edgeUUID, 404)
+        return
+    }
+    json.NewEncoder(w).Encode(&a)
+}
+
+// status of one edgeaccess shown by the admin API
+type EDGEACCESS_STATUS struct {
+    EdgeAccessHome string    `json:"edgeaccess_home"`
+    LastResponse   time.Time `json:"last_response"`
+    SinceResponse  int       `json:"seconds_since_response"`
+    Alive          bool      `json:"alive"`
+    Healthy        bool      `json:"healthy"`
+    Ejected        bool      `json:"ejected"`
+    LatencyMS      float64   `json:"avg_latency_ms"`
+    Cordoned       bool      `json:"cordoned"`
+    Static         bool      `json:"static"`
+    ConnNum        int       `json:"conn_num"`
+    Pending        int       `json:"pending"`
+    MaxConn        int       `json:"max_conn"`
+    Host           string    `json:"host"`
+    Port           string    `json:"port"`
+    ToEdged        string    `json:"toedged_path"`
+    ToEdgeAccess   string    `json:"toedgeaccess_path"`
+    BiAsync        string    `json:"biasync_path"`
+    Labels         map[string]string `json:"labels"`
+}
+
+// adminEdgeAccessHandler lists every edgeaccess with the liveness computed
+// against hearbroken_interval
+func adminEdgeAccessHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+
+    now  := time.Now()
+    list := listEdgeAccess.Snapshot()
+
+    status := make([]EDGEACCESS_STATUS, 0, len(list))
+    for _, v := range list {
+        var st EDGEACCESS_STATUS
+        st.EdgeAccessHome = v.EdgeAccessHome
+        st.LastResponse   = v.LastResponse
+        st.SinceResponse  = int(now.Sub(v.LastResponse).Seconds())
+        st.Alive          = isAlive(&v, now)
+        st.Healthy        = v.Healthy
+        st.Ejected        = v.Ejected
+        st.LatencyMS      = float64(v.AvgLatency) / float64(time.Millisecond)
+        st.Cordoned       = v.Cordoned
+        st.Static         = v.Static
+        st.ConnNum        = v.PingResp.ConnNum
+        st.Pending        = v.Pending
+        st.MaxConn        = v.PingResp.MaxConn
+        st.Host           = v.PingResp.Host
+        st.Port           = v.PingResp.Port
+        st.ToEdged        = v.PingResp.ToEdged
+        st.ToEdgeAccess   = v.PingResp.ToEdgeAccess
+        st.BiAsync        = v.PingResp.BiAsync
+        st.Labels         = v.PingResp.Labels
+        status = append(status, st)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(status)
+}
+
+// adminCordonHandler cordons or uncordons the edgeaccess given by the
+// edgeaccess_home query, depends on the path
+func adminCordonHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+    if !checkAdminToken(w, r) {
+        return
+    }
+
+    home := r.URL.Query().Get("edgeaccess_home")
+    if home == "" {
+        http.Error(w, "edgeaccess_home is required", 400)
+        return
+    }
+
+    cordoned := strings.HasSuffix(r.URL.Path, "/cordon")
+    found, err := listEdgeAccess.SetCordon(home, cordoned)
+    if !found {
+        http.Error(w, "EdgeAccess not found", 404)
+        return
+    }
+    if err != nil {
+        log.Println("persist cordon failed", home, err)
+        http.Error(w, err.Error(), 500)
+        return
+    }
+
+    log.Println("EdgeAccess", home, "cordoned:", cordoned)
+    if cordoned {
+        events.Publish(EVENT{Type: EVENT_CORDON, EdgeAccessHome: home})
+    } else {
+        events.Publish(EVENT{Type: EVENT_UNCORDON, EdgeAccessHome: home})
+    }
+    w.WriteHeader(http.StatusOK)
 }
 
+// directoryHandler receives the attach/detach events from EdgeAccess with
+// POST, and lists all the entries with GET
+func directoryHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" && r.Method != "GET" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+    if !checkAdminToken(w, r) {
+        return
+    }
+    if r.Method == "GET" {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(directory.List())
+        return
+    }
+    if r.Body == nil {
+        http.Error(w, "Please send a request body", 400)
+        return
+    }
+
+    var e DIRECTORY_EVENT
+    err := json.NewDecoder(r.Body).Decode(&e)
+    if err != nil {
+        http.Error(w, err.Error(), 400)
+        return
+    }
+    if e.EdgeNodeID == "" || e.EdgeAccessHome == "" {
+        http.Error(w, "edgenode_id and edgeaccess_home are required", 400)
+        return
+    }
+    if e.Event != DIRECTORY_ATTACH && e.Event != DIRECTORY_DETACH {
+        http.Error(w, "event should be attach or detach", 400)
+        return
+    }
+
+    if directory.Apply(&e) {
+        log.Println("directory", e.Event, e.EdgeNodeID, e.EdgeAccessHome)
+        if e.Event == DIRECTORY_ATTACH {
+            recordAttach(e.EdgeNodeID, e.EdgeAccessHome)
+        }
+    }
+    w.WriteHeader(http.StatusOK)
+}
 
-type EDGEACCESS_PING struct {
-    ConnNum        int    `json:"conn_num"`
-    Host           string `json:"host"`
-    Port           string `json:"port"`
-    ToEdged        string `json:"toedged_path"`
-    ToEdgeAccess   string `json:"toedgeaccess_path"`
-    BiAsync        string `json:"biasync_path"`
+// syncDirectory resyncs the directory with the edge nodes attached to the
+// EdgeAccess, so the entries lost by a restart or dropped by a failed probe
+// come back with the next registration renewal
+func syncDirectory(home string, attached []string, seq uint64) {
+    added, removed := directory.Sync(home, attached, seq)
+    for _, id := range added {
+        log.Println("directory sync attach", id, home)
+        recordAttach(id, home)
+    }
+    for _, id := range removed {
+        log.Println("directory sync detach", id, home)
+    }
 }
 
-type EdgeAccess struct {
-    LastResponse   time.Time `json:"last_response"`
-    EdgeAccessHome string    `json:"edgeaccess_home"`
-    PingResp       EDGEACCESS_PING `json:"ping_resp"`
+// recordAttach updates the assignment to the EdgeAccess the edge node
+// attached to, edged may have walked to a fallback of the candidates
+func recordAttach(edgeUUID string, home string) {
+    v, ok := listEdgeAccess.Get(home)
+    if !ok || v.PingResp.Host == "" {
+        return
+    }
+
+    var ea EDGEACCESS_URL
+    fillEdgeAccessURL(&ea, &v)
+    a, changed := assignments.Attach(edgeUUID, &ea)
+    if changed {
+        log.Println("assignment of", edgeUUID, "moved to", home)
+        events.Publish(EVENT{Type: EVENT_ASSIGNMENT,
+                             EdgeNodeID: edgeUUID,
+                             ProjectID: a.ProjectID,
+                             EdgeAccess: &ea,
+                             Detail: "attached"})
+    }
 }
-type EdgeAccesses []EdgeAccess
-func (p EdgeAccesses) Len() int { return len(p) }
-func (p EdgeAccesses) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
-func (p EdgeAccesses) Less(i, j int) bool {
-    return p[i].PingResp.ConnNum < p[j].PingResp.ConnNum
+
+// directoryLookupHandler serves /v1.0/directory/{edgenode_id}
+func directoryLookupHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        http.Error(w, "method not allowed", 405)
+        return
+    }
+
+    edgeUUID := strings.TrimPrefix(r.URL.Path, "/v1.0/directory/")
+    if edgeUUID == "" || strings.Contains(edgeUUID, "/") {
+        http.Error(w, "invalid edge node id", 400)
+        return
+    }
+
+    entry, ok := directory.Lookup(edgeUUID)
+    if !ok {
+        http.Error(w, "edge node not attached", 404)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(&entry)
 }
-var listEdgeAccess EdgeAccesses
 
+// watchHandler streams the events as Server-Sent Events, the types of
+// the events can be filtered by the comma separated type query
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "streaming not supported", 500)
+        return
+    }
 
-type CONFIGURATION struct {
-    Host string `json:"host"`
-    Port string `json:"port"`
+    types := make(map[string]bool)
+    for _, t := range strings.Split(r.URL.Query().Get("type"), ",") {
+        if t != "" {
+            types[t] = true
+        }
+    }
 
-    PingInterval int `json:"ping_interval"`
-    HeartBroken  int `json:"hearbroken_interval"`
+    ch := events.Subscribe()
+    defer events.Unsubscribe(ch)
 
-    //a list of EdgeAccess home url
-    EdgeAccessHomes []string `json:"edgeaccess_homes"`
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    log.Println("watcher connected", r.RemoteAddr)
+
+    // keep the idle stream alive through the proxies
+    ticker := time.NewTicker(15*time.Second)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case e := <-ch:
+            if len(types) > 0 && !types[e.Type] {
+                continue
+            }
+            data, _ := json.Marshal(&e)
+            _, err := io.WriteString(w, "id: " + strconv.FormatUint(e.ID, 10) +
+                                        "\nevent: " + e.Type +
+                                        "\ndata: " + string(data) + "\n\n")
+            if err != nil {
+                return
+            }
+            flusher.Flush()
+        case <-ticker.C:
+            _, err := io.WriteString(w, ": keep-alive\n\n")
+            if err != nil {
+                return
+            }
+            flusher.Flush()
+        case <-r.Context().Done():
+            log.Println("watcher disconnected", r.RemoteAddr)
+            return
+        }
+    }
 }
 
-// global variables used in this file
-var conf CONFIGURATION
+// getNewEdgeAccess finds the EdgeAccess for the edge node, the last one is
+// preferred and the drained one is avoided if there are others
+func getNewEdgeAccess(edgeUUID string, projectUUID string, labels map[string]string,
+                      lastHost string, lastPort string, drained *EDGEACCESS_URL,
+                      ea *EDGEACCESS_URL) error {
 
+    log.Println("Try to find a new proper for", projectUUID, edgeUUID, lastHost, lastPort)
 
-/* note: error and  exception are not carefully handled here */
+    // only the EdgeAccess in the pool of the project can be chosen
+    now  := time.Now()
+    list := pools.Filter(projectUUID, listEdgeAccess.Snapshot())
 
-func main() {
+    // only the alive and uncordoned ones not reaching the maximum connection number
+    // are candidates, the list is still sorted by the connection number
+    alive      := 0
+    candidates := make(EdgeAccesses, 0, len(list))
+    for _, v := range list {
+        if !isAlive(&v, now) || v.Cordoned {
+            continue
+        }
+        alive++
+        if !isFull(&v) {
+            candidates = append(candidates, v)
+        }
+    }
 
-    if initConfAndVar(&conf) != nil {
-        return
+    // the edge node handed back by the rebalance would be hashed or
+    // picked back to the same one
+    candidates = excludeEdgeAccess(candidates, drained)
+
+    // the strategy only selects among the nearest ones
+    candidates = nearestEdgeAccess(labels, candidates)
+
+    // the last one is selected in priority if it's still among the nearest
+    // candidates, so an edge node once placed across the WAN comes back
+    // when its own zone has capacity again
+    if lastHost != "" && lastPort != "" {
+        for _, v := range candidates {
+            if v.PingResp.Host == lastHost && v.PingResp.Port == lastPort {
+                fillEdgeAccessURL(ea, &v)
+                listEdgeAccess.AddPending(v.EdgeAccessHome)
+                metrics.IncRequest(OUTCOME_STICKY_HIT)
+                log.Println("Find the last one, Host", ea.Host,
+                            "Port", ea.Port,
+                            "ToEdged", ea.ToEdged)
+                return nil
+            }
+        }
     }
 
-    http.HandleFunc("/v1.0/edgeaccess", edgeAccessHandler)
+    if len(candidates) > 0 {
+        v := selectStrategy.Select(edgeUUID, candidates)
+        if v != nil {
+            fillEdgeAccessURL(ea, v)
+            listEdgeAccess.AddPending(v.EdgeAccessHome)
+            metrics.IncRequest(OUTCOME_NEW_PICK)
+            log.Println("Find a new one by", selectStrategy.Name(),
+                        "Host", ea.Host,
+                        "Port", ea.Port,
+                        "ToEdged", ea.ToEdged)
+            return nil
+        }
+    }
 
-    go healthCollect()
+    if alive > 0 {
+        log.Println("All", alive, "alive edgeaccess are saturated")
+        metrics.IncRequest(OUTCOME_NO_CAPACITY)
+        return errNoCapacity
+    }
 
-    //use https instead
-    http.ListenAndServe(conf.Host+":"+conf.Port, nil)
+    metrics.IncRequest(OUTCOME_NO_EDGEACCESS)
+    log.Println("Error in finding proper edgeaccess")
+    return errNoEdgeAccess
 }
 
-func initConfAndVar(conf *CONFIGURATION) error {
+// excludeEdgeAccess removes the one from the candidates, unless it's the
+// only candidate
+func excludeEdgeAccess(candidates EdgeAccesses, ea *EDGEACCESS_URL) EdgeAccesses {
+    if ea == nil || ea.Host == "" {
+        return candidates
+    }
+    others := make(EdgeAccesses, 0, len(candidates))
+    for _, v := range candidates {
+        if v.PingResp.Host != ea.Host || v.PingResp.Port != ea.Port {
+            others = append(others, v)
+        }
+    }
+    if len(others) == 0 {
+        return candidates
+    }
+    return others
+}
 
-    //load CLI parameters and configuration
-    var f string
-    flag.StringVar(&f, "f", "placement.conf", "path for configuration file")
-    flag.Parse()
+// isAlive tells whether the edgeaccess is healthy, not ejected, and
+// answered within hearbroken_interval, the one never answered is not
+// alive since its url is not known yet
+func isAlive(v *EdgeAccess, now time.Time) bool {
+    if v.PingResp.Host == "" || !v.Healthy || v.Ejected {
+        return false
+    }
+    diff := now.Sub(v.LastResponse)
+    return int(diff.Seconds()) < liveConf().HeartBroken
+}
 
-    err  := getConfig(conf, f)
-    if err != nil {
-        log.Println("read configuration failed: ", err)
-        return err
+// listFallbackEdgeAccess returns at most max alive EdgeAccess in the pool
+// of the project other than the primary one, the nearest ones come first,
+// then the least loaded ones
+func listFallbackEdgeAccess(projectUUID string, labels map[string]string,
+                            primary *EDGEACCESS_URL, max int) []EDGEACCESS_URL {
+    now       := time.Now()
+    fallbacks := make([]EDGEACCESS_URL, 0)
+    list      := pools.Filter(projectUUID, listEdgeAccess.Snapshot())
+    sortByTopology(labels, list)
+    for _, v := range list {
+        if len(fallbacks) >= max {
+            break
+        }
+        if v.PingResp.Host == primary.Host && v.PingResp.Port == primary.Port {
+            continue
+        }
+        if !isAlive(&v, now) || v.Cordoned || isFull(&v) {
+            continue
+        }
+
+        var ea EDGEACCESS_URL
+        fillEdgeAccessURL(&ea, &v)
+        fallbacks = append(fallbacks, ea)
     }
+    return fallbacks
+}
 
-    log.Println("configuration conf.Host", conf.Host)
-    log.Println("configuration conf.Port", conf.Port)
-    log.Println("configuration conf.PingInterval", conf.PingInterval)
-    log.Println("configuration conf.HeartBroken", conf.HeartBroken)
-    log.Println("configuration conf.EdgeAccessHomes", conf.EdgeAccessHomes)
+// topologyTier tells how far the EdgeAccess is from the edge node, 0 for
+// the same zone, 1 for the same region, then the nearest regions in the
+// order of nearest_regions, the others are the farthest
+func topologyTier(labels map[string]string, v *EdgeAccess) int {
+    region := labels[LABEL_REGION]
+    zone   := labels[LABEL_ZONE]
+    if region == "" && zone == "" {
+        return 0
+    }
 
-    // global varibles initialization
-    initEdgeAccessList()
+    eaRegion := v.PingResp.Labels[LABEL_REGION]
+    if eaRegion == region || region == "" {
+        if zone != "" && v.PingResp.Labels[LABEL_ZONE] == zone {
+            return 0
+        }
+        return 1
+    }
 
-    return nil
+    nearest := conf.NearestRegions[region]
+    for i, r := range nearest {
+        if r == eaRegion {
+            return 2 + i
+        }
+    }
+    return 2 + len(nearest)
 }
 
-func initEdgeAccessList() {
-    var ea EdgeAccess
-    ea.LastResponse           = time.Now()
-    ea.EdgeAccessHome         = ""
-    ea.PingResp.ConnNum       = 0
-    ea.PingResp.Host          = ""
-    ea.PingResp.Port          = ""
-    ea.PingResp.ToEdged       = ""
-    ea.PingResp.ToEdgeAccess  = ""
-    ea.PingResp.BiAsync       = ""
+// nearestEdgeAccess returns the candidates in the nearest tier
+func nearestEdgeAccess(labels map[string]string, candidates EdgeAccesses) EdgeAccesses {
+    best    := -1
+    nearest := make(EdgeAccesses, 0, len(candidates))
+    for _, v := range candidates {
+        tier := topologyTier(labels, &v)
+        if best < 0 || tier < best {
+            best    = tier
+            nearest = nearest[:0]
+        }
+        if tier == best {
+            nearest = append(nearest, v)
+        }
+    }
+    return nearest
+}
 
-    for _, v := range conf.EdgeAccessHomes {
-        ea.EdgeAccessHome = v
-        listEdgeAccess = append(listEdgeAccess, ea)
+// sortByTopology sorts the list by the tier, the order in the same tier
+// is kept
+func sortByTopology(labels map[string]string, list EdgeAccesses) {
+    sort.SliceStable(list, func(i, j int) bool {
+        return topologyTier(labels, &list[i]) < topologyTier(labels, &list[j])
+    })
+}
+
+// isFull also counts the edge nodes sent to it since the last ping, so a
+// burst of placements doesn't all go to the same one
+func isFull(v *EdgeAccess) bool {
+    return v.PingResp.MaxConn > 0 && v.Load() >= v.PingResp.MaxConn
+}
+
+func fillEdgeAccessURL(ea *EDGEACCESS_URL, v *EdgeAccess) {
+    ea.Host         = v.PingResp.Host
+    ea.Port         = v.PingResp.Port
+    ea.ToEdged      = v.PingResp.ToEdged
+    ea.ToEdgeAccess = v.PingResp.ToEdgeAccess
+    ea.BiAsync      = v.PingResp.BiAsync
+}
+
+// SelectStrategy picks one edgeaccess out of the alive candidates for
+// the edge node, the candidates are sorted by the connection number
+// and never empty
+type SelectStrategy interface {
+    Name() string
+    Select(edgeUUID string, candidates EdgeAccesses) *EdgeAccess
+}
+
+const (
+    STRATEGY_LEAST_CONN      = "least_conn"
+    STRATEGY_WEIGHTED_RR     = "weighted_round_robin"
+    STRATEGY_CONSISTENT_HASH = "consistent_hash"
+    STRATEGY_RANDOM_TWO      = "random_two"
+)
+
+func newSelectStrategy(name string, weights map[string]int) (SelectStrategy, error) {
+    switch name {
+    case "", STRATEGY_LEAST_CONN:
+        return &leastConnStrategy{}, nil
+    case STRATEGY_WEIGHTED_RR:
+        return &weightedRRStrategy{weights: weights,
+                                   current: make(map[string]int)}, nil
+    case STRATEGY_CONSISTENT_HASH:
+        return &consistentHashStrategy{replicas: 100}, nil
+    case STRATEGY_RANDOM_TWO:
+        return &randomTwoStrategy{
+            rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
     }
+    return nil, errors.New("unknown strategy " + name)
+}
+
+// leastConnStrategy picks the least connected one
+type leastConnStrategy struct{}
 
-    log.Println("listEdgeAccess:", listEdgeAccess)
+func (s *leastConnStrategy) Name() string { return STRATEGY_LEAST_CONN }
+
+func (s *leastConnStrategy) Select(edgeUUID string, candidates EdgeAccesses) *EdgeAccess {
+    return &candidates[0]
 }
 
-func getConfig( config *CONFIGURATION, f string) error {
-    file, _ := os.Open(f)
-    defer file.Close()
+// weightedRRStrategy is the smooth weighted round-robin, the weight of
+// each edgeaccess home comes from edgeaccess_weights, 1 by default
+type weightedRRStrategy struct {
+    lock    sync.Mutex
+    weights map[string]int
+    current map[string]int
+}
 
-    decoder := json.NewDecoder(file)
-    err := decoder.Decode(config)
-    return err
+func (s *weightedRRStrategy) Name() string { return STRATEGY_WEIGHTED_RR }
+
+func (s *weightedRRStrategy) weight(home string) int {
+    if w, ok := s.weights[home]; ok && w > 0 {
+        return w
+    }
+    return 1
 }
 
-func edgeAccessHandler(w http.ResponseWriter, r *http.Request) {
-    // extract the project-id and edge node id from cert
-    // now we just extract edge node id from the header
-    edgeUUID := r.Header.Get("edgenode_id")
+func (s *weightedRRStrategy) Select(edgeUUID string, candidates EdgeAccesses) *EdgeAccess {
+    s.lock.Lock()
+    defer s.lock.Unlock()
 
-    // TODO: node validation
-    edgeUUID = edgeUUID
+    total := 0
+    best  := -1
+    for i, v := range candidates {
+        w := s.weight(v.EdgeAccessHome)
+        total += w
+        s.current[v.EdgeAccessHome] += w
+        if best < 0 ||
+            s.current[v.EdgeAccessHome] > s.current[candidates[best].EdgeAccessHome] {
+            best = i
+        }
+    }
+    s.current[candidates[best].EdgeAccessHome] -= total
+    return &candidates[best]
+}
 
-    log.Println("receive request from", edgeUUID)
+// consistentHashStrategy hashes the edge node id onto a ring of the
+// candidates, so only the nodes of the leaving/joining edgeaccess move
+type consistentHashStrategy struct {
+    replicas int
+}
 
-    var lastEU, newEU EDGEACCESS_URL
-    if r.Body == nil {
-        http.Error(w, "Please send a request body", 400)
-        return
+func (s *consistentHashStrategy) Name() string { return STRATEGY_CONSISTENT_HASH }
+
+func hashKey(key string) uint32 {
+    h := fnv.New32a()
+    h.Write([]byte(key))
+    return h.Sum32()
+}
+
+func (s *consistentHashStrategy) Select(edgeUUID string, candidates EdgeAccesses) *EdgeAccess {
+    type point struct {
+        hash  uint32
+        index int
     }
-    err := json.NewDecoder(r.Body).Decode(&lastEU)
-    if err != nil {
-        http.Error(w, err.Error(), 400)
-        return
+
+    // the ring is rebuilt for each selection, it's cheap for dozens
+    // of edgeaccess, and always matches the alive candidates
+    ring := make([]point, 0, len(candidates)*s.replicas)
+    for i, v := range candidates {
+        for r := 0; r < s.replicas; r++ {
+            key := v.EdgeAccessHome + "#" + strconv.Itoa(r)
+            ring = append(ring, point{hashKey(key), i})
+        }
     }
+    sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
 
-    err = getNewEdgeAccess(lastEU.Host, lastEU.Port, &newEU)
+    h := hashKey(edgeUUID)
+    i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+    if i == len(ring) {
+        i = 0
+    }
+    return &candidates[ring[i].index]
+}
 
-    if err != nil {
-        http.Error(w, "no EdgeAccess is available, try again later", 404)
-        return
+// randomTwoStrategy picks two candidates randomly, and takes the less
+// connected one of them
+type randomTwoStrategy struct {
+    lock sync.Mutex
+    rnd  *rand.Rand
+}
+
+func (s *randomTwoStrategy) Name() string { return STRATEGY_RANDOM_TWO }
+
+func (s *randomTwoStrategy) Select(edgeUUID string, candidates EdgeAccesses) *EdgeAccess {
+    if len(candidates) == 1 {
+        return &candidates[0]
     }
 
-    json.NewEncoder(w).Encode(&newEU)
+    s.lock.Lock()
+    i := s.rnd.Intn(len(candidates))
+    j := s.rnd.Intn(len(candidates) - 1)
+    s.lock.Unlock()
+
+    if j >= i {
+        j++
+    }
+    if candidates[j].Load() < candidates[i].Load() {
+        i = j
+    }
+    return &candidates[i]
 }
 
-func getNewEdgeAccess(lastHost string, lastPort string, ea *EDGEACCESS_URL) error {
+// reason sent by edged in the reconnect_reason header
+const RECONNECT_REBALANCE = "rebalance"
 
-    log.Println("Try to find a new proper for", lastHost, lastPort)
+// rebalanceLoop checks the imbalance among the live EdgeAccess
+// periodically, and asks the overloaded ones to hand sessions back
+func rebalanceLoop() {
 
-    now := time.Now()
+    ticker := time.NewTicker(time.Duration(conf.RebalanceInterval)*time.Second)
+    defer ticker.Stop()
 
-    // check to see if the last one is alive yet, it
-    // should be selected in priority
-    // if lastHost == "", should go to the next "for" loop for faster search
-    for _, v := range listEdgeAccess {
-        if v.PingResp.Host == lastHost &&
-            lastHost != "" &&
-            v.PingResp.Port == lastPort &&
-            lastPort != "" {
-            diff := now.Sub(v.LastResponse)
-            if int(diff.Seconds()) < conf.HeartBroken {
-                ea.Host         = v.PingResp.Host
-                ea.Port         = v.PingResp.Port
-                ea.ToEdged      = v.PingResp.ToEdged
-                ea.ToEdgeAccess = v.PingResp.ToEdgeAccess
-                ea.BiAsync      = v.PingResp.BiAsync
-                log.Println("Find the last one, Host", ea.Host,
-                            "Port", ea.Port,
-                            "ToEdged", ea.ToEdged)
-                return nil
-            } else {
-                // need to find another alive EdgeAccess with least
-                // connection number
-                break
-            }
+    for {
+        select {
+        case <-ticker.C:
+            rebalance()
         }
     }
+}
 
-    // just check out the least/alive one in the sorted list
-    // should check whether the connection number reaches the maximum
-    // or not
-    for _, v := range listEdgeAccess {
-        diff := now.Sub(v.LastResponse)
-        if int(diff.Seconds()) < conf.HeartBroken {
-            ea.Host         = v.PingResp.Host
-            ea.Port         = v.PingResp.Port
-            ea.ToEdged      = v.PingResp.ToEdged
-            ea.ToEdgeAccess = v.PingResp.ToEdgeAccess
-            ea.BiAsync      = v.PingResp.BiAsync
-            log.Println("Find a new one, Host", ea.Host,
-                        "Port", ea.Port,
-                        "ToEdged", ea.ToEdged)
-            return nil
+func rebalance() {
+
+    now  := time.Now()
+    list := listEdgeAccess.Snapshot()
+
+    // edge nodes never move across pools, so each pool is balanced
+    // on its own
+    groups := make(map[string]EdgeAccesses)
+    for _, v := range list {
+        if isAlive(&v, now) && !v.Cordoned {
+            name := pools.PoolOf(v.EdgeAccessHome)
+            groups[name] = append(groups[name], v)
         }
     }
 
-    log.Println("Error in finding proper edgeaccess")
-    return errors.New("Error in finding proper edgeaccess")
+    for _, live := range groups {
+        rebalancePool(live)
+    }
+}
+
+func rebalancePool(live EdgeAccesses) {
+
+    if len(live) < 2 {
+        return
+    }
+
+    total := 0
+    for _, v := range live {
+        total += v.PingResp.ConnNum
+    }
+
+    // the sessions over the average are handed back, so they can be
+    // picked up by the less loaded ones
+    avg    := float64(total) / float64(len(live))
+    target := int(math.Ceil(avg))
+    for _, v := range live {
+        if float64(v.PingResp.ConnNum) <= avg*(1+conf.RebalanceThreshold) {
+            continue
+        }
+
+        // the sessions handed back are still counted until a fresh ping
+        if !v.LastResponse.After(v.DrainedAt) {
+            log.Println("Rebalance", v.EdgeAccessHome, "skipped, waiting for a ping after the last drain")
+            continue
+        }
+
+        count := v.PingResp.ConnNum - target
+        if count > conf.RebalanceMaxSessions {
+            count = conf.RebalanceMaxSessions
+        }
+        if count <= 0 {
+            continue
+        }
+
+        log.Println("Rebalance", v.EdgeAccessHome, "conn", v.PingResp.ConnNum,
+                    "average", avg, "hand back", count)
+        events.Publish(EVENT{Type: EVENT_DRAIN,
+                             EdgeAccessHome: v.EdgeAccessHome,
+                             Detail: "hand back " + strconv.Itoa(count) + " sessions"})
+        listEdgeAccess.MarkDrained(v.EdgeAccessHome)
+        go askRebalance(v.EdgeAccessHome, count)
+    }
+}
+
+func askRebalance(home string, count int) {
+    // TODO: use https instead
+    client := &http.Client{Timeout: time.Duration(liveConf().PingInterval)*time.Second}
+
+    req, err := http.NewRequest("POST",
+                                home+"/v1.0/rebalance?count="+strconv.Itoa(count),
+                                nil)
+    if err != nil {
+        log.Println(err)
+        return
+    }
+    req.Header.Add("admin_token", conf.AdminToken)
+
+    resp, err := client.Do(req)
+    if err != nil {
+        log.Println("ask rebalance failed", home, err)
+        return
+    }
+    defer resp.Body.Close()
+
+    // the sessions are handed back by now, wait for the ping after that
+    listEdgeAccess.MarkDrained(home)
+
+    respBody, _ := ioutil.ReadAll(resp.Body)
+    log.Println("Rebalance", home, resp.Status, string(respBody))
 }
 
 func healthCollect() {
 
     //collect heath status of EdgeAccess servers, every minutes
-    ticker := time.NewTicker(time.Duration(conf.PingInterval)*time.Second)
+    ticker := time.NewTicker(time.Duration(liveConf().PingInterval)*time.Second)
     defer ticker.Stop()
 
     for {
         select {
+        case <-healthReset:
+            interval := time.Duration(liveConf().PingInterval)*time.Second
+            ticker.Reset(interval)
+            log.Println("health collect interval reset to", interval)
         case <-ticker.C:
-            for i, _ := range listEdgeAccess {
-                //collect heath for each server
-                go pingEdgeAccessServer(&listEdgeAccess[i])
+            ttl := time.Duration(liveConf().RegisterTTL)*time.Second
+            for _, home := range listEdgeAccess.Expire(ttl) {
+                log.Println("EdgeAccess registration expired", home)
+                directory.DropEdgeAccess(home)
+                events.Publish(EVENT{Type: EVENT_EXPIRED, EdgeAccessHome: home})
+            }
+
+            ejected, recovered := listEdgeAccess.DetectOutliers()
+            for _, home := range ejected {
+                log.Println("EdgeAccess ejected as outlier", home)
+                events.Publish(EVENT{Type: EVENT_EJECTED, EdgeAccessHome: home})
             }
+            for _, home := range recovered {
+                log.Println("EdgeAccess recovered from ejection", home)
+                events.Publish(EVENT{Type: EVENT_RECOVERED, EdgeAccessHome: home})
+            }
+
+            for _, home := range listEdgeAccess.Homes() {
+                //collect heath for each server, skip the one whose
+                //last probe is still in flight
+                if listEdgeAccess.BeginProbe(home) {
+                    go pingEdgeAccessServer(home)
+                }
+            }
+        }
+    }
+}
+
+func pingEdgeAccessServer(home string) {
+    result, latency, err := probeEdgeAccessServer(home)
+    if err != nil {
+        log.Println("Ping", home, "failed:", err)
+        metrics.IncProbeFailure()
+        if listEdgeAccess.ProbeFailed(home) {
+            log.Println("EdgeAccess down", home)
+            directory.DropEdgeAccess(home)
+            events.Publish(EVENT{Type: EVENT_DOWN, EdgeAccessHome: home})
         }
+        return
+    }
+
+    //the registry serializes the update, and the handlers will get
+    //the sorted snapshot of it, so no need to sort here any more
+    metrics.ObserveProbe(latency)
+    found, up := listEdgeAccess.UpdatePing(home, result, latency)
+    if !found {
+        log.Println("Ping", home, "not registered any more")
+    }
+    if up {
+        log.Println("EdgeAccess up", home)
+        events.Publish(EVENT{Type: EVENT_UP, EdgeAccessHome: home})
     }
 }
 
-func pingEdgeAccessServer(ea *EdgeAccess) {
+func probeEdgeAccessServer(home string) (*EDGEACCESS_PING, time.Duration, error) {
     // TODO: use https instead
-    client := &http.Client{}
+    client := &http.Client{Timeout: time.Duration(liveConf().ProbeTimeout)*time.Second}
 
-    log.Println("Ping server", ea.EdgeAccessHome+"/v1.0/ping")
+    log.Println("Ping server", home+"/v1.0/ping")
     // use https instead
     // edgeAccessHome should be regulated to shceme https://host:port
     // some server can handle the format https://host:port/v1.0/ping/, but not all
     req, err := http.NewRequest("GET",
-                                ea.EdgeAccessHome+"/v1.0/ping", nil)
+                                home+"/v1.0/ping", nil)
     if err != nil {
-        log.Println(err)
-        return
+        return nil, 0, err
     }
 
+    start := time.Now()
     req.Header.Add("Accept", "application/json")
     resp, err := client.Do(req)
     if err != nil {
-        log.Println(err)
-        return
+        return nil, 0, err
     }
     defer resp.Body.Close()
 
     respBody, err := ioutil.ReadAll(resp.Body)
     if err != nil {
-        log.Println(err)
-        return
+        return nil, 0, err
+    }
+    latency := time.Since(start)
+
+    if resp.StatusCode != 200 {
+        return nil, 0, errors.New("ping response " + resp.Status)
     }
 
-    log.Println("Ping", ea.EdgeAccessHome, "response is", string(respBody))
+    log.Println("Ping", home, "response is", string(respBody), "in", latency)
 
     result := &EDGEACCESS_PING{}
     err = json.Unmarshal([]byte(respBody), result)
     if err != nil {
-        log.Println(err)
-        return
+        return nil, 0, err
     }
-
-    //pointer is passed here, so we just need to update the
-    //respose time and connection number.
-    ea.LastResponse           = time.Now()
-    ea.PingResp.ConnNum       = result.ConnNum
-    ea.PingResp.Host          = result.Host
-    ea.PingResp.Port          = result.Port
-    ea.PingResp.ToEdged       = result.ToEdged
-    ea.PingResp.ToEdgeAccess  = result.ToEdgeAccess
-    ea.PingResp.BiAsync       = result.BiAsync
-
-    //it may be too freequent sorting if multiple
-    //edge access servers reponse in parrarell
-    //no lock also means no precise in control
-    sort.Sort(listEdgeAccess)
+    return result, latency, nil
 }
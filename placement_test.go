@@ -0,0 +1,75 @@
+package main
+
+import (
+        "testing"
+        "time"
+)
+
+func newOutlierRegistry(latencies map[string]time.Duration) *EdgeAccessRegistry {
+    r := NewEdgeAccessRegistry(HealthPolicy{
+        FailThreshold:     3,
+        SuccessThreshold:  2,
+        OutlierFactor:     3,
+        OutlierMinLatency: 10*time.Millisecond,
+        EjectDuration:     time.Minute,
+        MaxEjectPercent:   50,
+    })
+    for _, home := range []string{"a", "b", "c"} {
+        r.Add(home, true)
+        ea := r.items[home]
+        ea.Healthy     = true
+        ea.LastLatency = latencies[home]
+        ea.AvgLatency  = latencies[home]
+    }
+    return r
+}
+
+func TestDetectOutliersEjectsTheSlowOne(t *testing.T) {
+    r := newOutlierRegistry(map[string]time.Duration{
+        "a": 5*time.Millisecond, "b": 5*time.Millisecond, "c": 200*time.Millisecond})
+
+    ejected, recovered := r.DetectOutliers()
+    if len(ejected) != 1 || ejected[0] != "c" || len(recovered) != 0 {
+        t.Fatalf("ejected %v, recovered %v, want c ejected only", ejected, recovered)
+    }
+}
+
+func TestDetectOutliersRecoversWithOneHealthyPeer(t *testing.T) {
+    r := newOutlierRegistry(map[string]time.Duration{
+        "a": 5*time.Millisecond, "b": 5*time.Millisecond, "c": 200*time.Millisecond})
+
+    r.DetectOutliers()
+    if !r.items["c"].Ejected {
+        t.Fatal("c is not ejected")
+    }
+
+    // a peer goes down, c is fast again after its ejection expires
+    r.items["a"].Healthy = false
+    c := r.items["c"]
+    c.LastLatency  = 5*time.Millisecond
+    c.EjectedUntil = time.Now().Add(-time.Second)
+
+    ejected, recovered := r.DetectOutliers()
+    if len(recovered) != 1 || recovered[0] != "c" || len(ejected) != 0 {
+        t.Fatalf("ejected %v, recovered %v, want c recovered only", ejected, recovered)
+    }
+    if c.Ejected {
+        t.Fatal("c is still ejected")
+    }
+}
+
+func TestDetectOutliersKeepsSlowOneEjected(t *testing.T) {
+    r := newOutlierRegistry(map[string]time.Duration{
+        "a": 5*time.Millisecond, "b": 5*time.Millisecond, "c": 200*time.Millisecond})
+
+    r.DetectOutliers()
+    r.items["a"].Healthy = false
+    c := r.items["c"]
+    c.EjectedUntil = time.Now().Add(-time.Second)
+
+    _, recovered := r.DetectOutliers()
+    if len(recovered) != 0 || !c.Ejected || c.EjectCount != 2 {
+        t.Fatalf("recovered %v, ejected %v, count %d, want c ejected again",
+                 recovered, c.Ejected, c.EjectCount)
+    }
+}